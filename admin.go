@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
 	"time"
 
@@ -8,12 +10,35 @@ import (
 	_ "github.com/GoAdminGroup/go-admin/modules/db/drivers/sqlite" // Import the sql driver
 	_ "github.com/GoAdminGroup/themes/adminlte"                    // Import the theme
 
+	"github.com/GoAdminGroup/go-admin/context"
 	"github.com/GoAdminGroup/go-admin/engine"
+	"github.com/GoAdminGroup/go-admin/modules/auth"
 	"github.com/GoAdminGroup/go-admin/modules/config"
 	"github.com/GoAdminGroup/go-admin/modules/language"
+	"github.com/GoAdminGroup/go-admin/plugins/admin/modules/form"
 	"github.com/gin-gonic/gin"
 )
 
+// _adminTokens are the CSRF tokens of GoAdmin, the forms of the custom
+// panels carry one too and each token is accepted once
+var _adminTokens *auth.TokenService
+
+var errInvalidCSRF = errors.New("the form has expired, reload the page and submit it again")
+
+// csrfField is the hidden field holding a CSRF token. A page renders one
+// token for all its forms, submitting one of them reloads the page.
+func csrfField(token string) string {
+	return fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, form.TokenKey, token)
+}
+
+// checkCSRF consumes the CSRF token of a posted form
+func checkCSRF(ctx *context.Context) error {
+	if !_adminTokens.CheckToken(ctx.FormValue(form.TokenKey)) {
+		return errInvalidCSRF
+	}
+	return nil
+}
+
 func useAdmin(r *gin.Engine) {
 	// Instantiate a GoAdmin engine object.
 	eng := engine.Default()
@@ -51,5 +76,21 @@ func useAdmin(r *gin.Engine) {
 	cfg.OpenAdminApi = true
 	// Add configuration and plugins, use the Use method to mount to the web framework.
 	_ = eng.AddConfig(&cfg).Use(r)
+	_adminTokens = auth.GetTokenService(eng.Services.Get(auth.TokenServiceKey))
 	eng.HTML("GET", "/info/keys", GetKeytable)
+	eng.Data("POST", "/keys/scopes", saveKeyScopesForm)
+	eng.Data("POST", "/keys/limits", saveKeyLimitsForm)
+	eng.Data("POST", "/keys/events", saveKeyEventsForm)
+	eng.Data("POST", "/keys/revoke", revokeKeyForm)
+	eng.HTML("POST", "/keys/rotate", rotateKeyPanel)
+	eng.Data("POST", "/keys/signing/rotate", rotateSigningKeyForm)
+	eng.Data("POST", "/keys/signing/retire", retireSigningKeyForm)
+	eng.HTML("GET", "/info/usage", GetUsagePanel)
+	eng.Data("GET", "/usage/export", exportUsage)
+	eng.HTML("GET", "/info/feedback", GetFeedbackPanel)
+	eng.Data("GET", "/feedback/export", exportFeedback)
+	eng.HTML("GET", "/info/webhooks", GetWebhookPanel)
+	eng.Data("POST", "/webhooks/retry", retryDeadLetter)
+	eng.HTML("GET", "/info/templates", GetTemplatePanel)
+	eng.Data("POST", "/templates/save", saveTemplateForm)
 }
@@ -7,42 +7,26 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	mathrand "math/rand"
-	"mime/multipart"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 	"github.com/russross/blackfriday/v2"
-	"go.mau.fi/whatsmeow"
-	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
 	"google.golang.org/protobuf/proto"
 )
 
-// Struct to represent the request body
-type MessageRequest struct {
-	Numbers []string         `form:"numbers"`
-	Message string           `form:"message"`
-	File    []multipart.File `form:"file"`
-}
-
 // Struct to represent the response
 type MessageResponse struct {
 	Message string `json:"message"`
 }
 
-// Struct to represent the response
-type ErrorResponse struct {
-	Reasons []string `json:"Reasons"`
-}
-
 // Map to store API keys and their corresponding messages
 
 // Paths for public and private key files
@@ -84,32 +68,81 @@ func run_api(wg *sync.WaitGroup) {
 	}
 	// init the api keys manager
 	_keymanager, _ = init_apikeymanager()
-	// println(_keymanager.GenerateAPIKey("kimo", time.Now().AddDate(0, 12, 0)))
-	// println(_keymanager.GenerateAPIKey("baddi", time.Now().AddDate(0, 12, 0)))
-	// Create a new Gin router
-	router := gin.Default()
+	// println(_keymanager.GenerateAPIKey("kimo", time.Now().AddDate(0, 12, 0), allScopes))
+	// println(_keymanager.GenerateAPIKey("baddi", time.Now().AddDate(0, 12, 0), defaultScopes))
+	// Start sending the queued jobs
+	startJobWorker()
+	router := apiRouter()
+	useAdmin(router)
+	// The spec is served from apiOperations, a route missing from it is a bug
+	if err := checkAPIRoutes(router.Routes()); err != nil {
+		log.Fatal(err)
+	}
+	// Start the server on port 8385
+	log.Fatal(router.Run(":8385"))
+}
+
+// apiRouter creates the router of the API, without the admin panel
+func apiRouter() *gin.Engine {
+	// Create a new Gin router, its access log hides the API keys of /events
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(redactedLogFormatter), gin.Recovery())
+	router.Use(requestID)
 
 	// Define the API endpoint with API key authentication
-	router.POST("/send-message", authenticate, sendMessage)
+	router.POST("/send-message", authenticate(ScopeSendText), idempotent, sendMessage)
+	router.GET("/jobs/:id", authenticate(ScopeSendText), getJob)
+	router.DELETE("/jobs/:id", authenticate(ScopeSendText), cancelJob)
+	router.POST("/webhooks", authenticate(ScopeAdmin), createWebhook)
+	router.GET("/webhooks", authenticate(ScopeAdmin), listWebhooks)
+	router.DELETE("/webhooks/:id", authenticate(ScopeAdmin), deleteWebhook)
+	router.GET("/groups", authenticate(ScopeGroupsManage), listGroups)
+	router.POST("/templates", authenticate(ScopeAdmin), createTemplate)
+	router.GET("/templates", authenticate(ScopeSendText), listTemplates)
+	router.GET("/templates/:name", authenticate(ScopeSendText), getTemplateVersions)
+	router.POST("/send-template", authenticate(ScopeSendText), idempotent, sendTemplate)
+	router.GET("/schedules", authenticate(ScopeSendText), listSchedules)
+	router.GET("/schedules/:id", authenticate(ScopeSendText), getSchedule)
+	router.DELETE("/schedules/:id", authenticate(ScopeSendText), deleteSchedule)
+	router.GET("/chats", authenticate(ScopeReadMessages), listChats)
+	router.GET("/chats/:jid/messages", authenticate(ScopeReadMessages), listChatMessages)
+	router.GET("/media/:id", authenticate(ScopeReadMessages), getMedia)
+	router.GET("/events", apiKeyFromQuery, authenticate(ScopeReadMessages), eventsHandler)
+	router.GET("/usage", authenticate(), getUsage)
+	router.GET("/usage/keys", authenticate(ScopeAdmin), listUsage)
+	router.POST("/keys/rotate", authenticate(), rotateKey)
+	router.DELETE("/keys/:id", authenticate(), revokeKey)
 	router.POST("/keygen", genkey)
 
 	// Define the root route
+	router.GET("/openapi.json", openAPISpec)
+	router.GET("/docs", docsHandler)
 	router.GET("/", mainHandler)
-	useAdmin(router)
-	// Start the server on port 8385
-	log.Fatal(router.Run(":8385"))
+	return router
 }
 
-// Middleware function to authenticate API key
-func authenticate(c *gin.Context) {
-	apiKey := c.GetHeader("X-API-Key")
-	valid, __err := _keymanager.ValidateAPIKey(apiKey)
-	if __err != nil || !valid {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Invalid API key: %v", __err)})
-	}
+// Middleware function to authenticate API key, the key must grant every
+// scope of the route and be under its rate limit
+func authenticate(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, __err := _keymanager.LookupAPIKey(c.GetHeader("X-API-Key"))
+		if __err != nil {
+			abortWithError(c, http.StatusUnauthorized, CodeUnauthorized, fmt.Sprintf("Invalid API key: %v", __err))
+			return
+		}
+		c.Set(apiKeyContextKey, apiKey)
+		for _, scope := range scopes {
+			if !requireScope(c, scope) {
+				return
+			}
+		}
+		if !rateLimit(c, apiKey) {
+			return
+		}
 
-	// Call the next handler
-	c.Next()
+		// Call the next handler
+		c.Next()
+	}
 }
 
 // Handler function for sending the message
@@ -117,7 +150,7 @@ func genkey(c *gin.Context) {
 	// Read the Protobuf message from the request body or any other source
 	data, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "Failed to read request body")
 		return
 	}
 
@@ -127,17 +160,18 @@ func genkey(c *gin.Context) {
 	// Unmarshal the Protobuf data into the KeyApiProto message
 	err = proto.Unmarshal(data, keyApi)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to unmarshal Protobuf data"})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "Failed to unmarshal Protobuf data")
 		return
 	}
 	if len(keyApi.GetSignedKey()) > 0 {
 		valid, __err := _keymanager.ValidateNewAPIKey(keyApi.GetSignedKey())
 		if __err != nil || !valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Invalid API key: %v", __err)})
+			abortWithError(c, http.StatusUnauthorized, CodeUnauthorized, fmt.Sprintf("Invalid API key: %v", __err))
+			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message": "Key API generated successfully"})
 	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to unmarshal Protobuf data"})
+		abortWithError(c, http.StatusBadRequest, CodeInvalidRequest, "Failed to unmarshal Protobuf data")
 	}
 	// Perform the necessary operations to generate the key API
 	// ...
@@ -148,190 +182,196 @@ func genkey(c *gin.Context) {
 
 // Handler function for sending the message
 func sendMessage(c *gin.Context) {
+	// Decode and validate the JSON or multipart body
+	req, errs := bindSendMessageRequest(c)
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+	// checked before any media URL is downloaded
+	for _, scope := range req.requiredScopes() {
+		if !requireScope(c, scope) {
+			return
+		}
+	}
+	if errs := req.prepare(); len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
 
-	// Parse the form data
-	err := c.Request.ParseMultipartForm(32 << 20) // 32MB max size
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+	if !requireConnection(c) {
 		return
 	}
 
-	// Extract the message field
-	message := c.Request.FormValue("message")
-	if len(message) > 600 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Message exceeds the maximum length of 600 characters"})
+	// Every number and group must resolve before the job starts
+	if errs := resolveRecipients(req); len(errs) > 0 {
+		abortWithFields(c, errs)
 		return
 	}
 
-	// Extract the numbers field
-	var numbers []string = []string{}
-	if len(c.Request.Form["numbers"]) > 0 {
-		numbers = strings.Fields(c.Request.Form["numbers"][0])
+	queueSendRequest(c, req)
+}
+
+// QueuedResponse is the 202 of a send request, with either a job or a schedule
+type QueuedResponse struct {
+	Message    string     `json:"message"`
+	JobID      string     `json:"job_id,omitempty"`
+	ScheduleID string     `json:"schedule_id,omitempty"`
+	NextRunAt  *time.Time `json:"next_run_at,omitempty"`
+	StatusURL  string     `json:"status_url"`
+}
+
+// queueSendRequest queues the job of a resolved request, or schedules it when
+// it is sent later, and writes the response
+func queueSendRequest(c *gin.Context, req *SendMessageRequest) {
+	wait, err := parseJobWait(c.Query("wait"))
+	if err != nil {
+		abortWithFields(c, FieldErrors{"wait": err.Error()})
+		return
 	}
-	if len(numbers) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Numbers field is required"})
+	// a schedule is charged for its first run, the next ones when they run
+	if !consumeQuota(c, req.quotaMessages()) {
 		return
 	}
-
-	// Handle the file field
-	files := c.Request.MultipartForm.File["file"]
-
-	var fileBytes []byte = []byte{}
-	var mimeType string = ""
-	var filename string = ""
-	var isfile bool = false
-	if len(files) > 0 {
-		filename = files[0].Filename
-		// Only process the first file in the slice
-		file, err := files[0].Open()
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the file"})
-			return
+	req.keyID = requestKeyID(c)
+	refund := func() {
+		if key := requestAPIKey(c); key != nil {
+			refundQuota(key, req.quotaMessages())
 		}
-		defer file.Close()
-
-		// Read the file bytes
-		fileBytes, err = ioutil.ReadAll(file)
+	}
+	// the groups of invite links are joined once nothing can reject the request
+	if errs := joinInviteLinks(req); len(errs) > 0 {
+		refund()
+		abortWithFields(c, errs)
+		return
+	}
+	if req.scheduled() {
+		schedule, err := createSchedule(req, ScheduleMessage)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the file"})
-			return
-		}
-
-		// Get the file's MIME type
-		mimeType = files[0].Header.Get("Content-Type")
-
-		// Check if the file type is allowed
-		if !isAllowedFileType(mimeType) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type. Allowed file types are: csv, pdf, docx, doc, xlsx, xls, png, jpeg, jpg, gif"})
+			refund()
+			abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Failed to schedule the message: %v", err))
 			return
 		}
-		isfile = true
-	}
-	// Send the message to the phone numbers (you can implement your own logic here)
-	// ...
-
-	// Call the sendThem function if all validations pass
-	done := sendThem(numbers, message, isfile, fileBytes, filename, mimeType, c)
-	if done {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Success!",
+		c.JSON(http.StatusAccepted, QueuedResponse{
+			Message:    "Scheduled",
+			ScheduleID: schedule.ID,
+			NextRunAt:  schedule.NextRunAt,
+			StatusURL:  "/schedules/" + schedule.ID,
 		})
+		return
 	}
-}
-func isAllowedFileType(mimeType string) bool {
-	fmt.Printf("Mimetype check: %s", mimeType)
-	allowedTypes := []string{
-		"application/pdf",
-		"text/csv",
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-		"application/msword",
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheetNumber",
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.documentNumber",
-		"application/vnd.ms-excel",
-		"application/zip[GIN]",
-		"application/zip",
-		"image/png",
-		"image/jpeg",
-		"image/jpg",
-		"image/gif",
+	// Queue the job, the numbers are sent in the background
+	job, err := enqueueSendJob(req)
+	if err != nil {
+		refund()
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Failed to queue the job: %v", err))
+		return
 	}
-
-	for _, allowedType := range allowedTypes {
-		if strings.EqualFold(mimeType, allowedType) {
-			return true
+	// With ?wait the response holds the result of every recipient once the job is over
+	if wait > 0 {
+		if done, err := waitSendJob(job.ID, wait); err == nil && done.finished() {
+			c.JSON(done.httpStatus(), done)
+			return
 		}
 	}
-
-	return false
+	c.JSON(http.StatusAccepted, QueuedResponse{
+		Message:   "Queued",
+		JobID:     job.ID,
+		StatusURL: "/jobs/" + job.ID,
+	})
 }
-func isImage(mimeType string) bool {
-	allowedTypes := []string{
-		"image/png",
-		"image/jpeg",
-		"image/jpg",
-		"image/gif",
-	}
 
-	for _, allowedType := range allowedTypes {
-		if strings.EqualFold(mimeType, allowedType) {
-			return true
-		}
+// sendThem sends the job to its pending recipients, storing the outcome of
+// each one as it goes. It stops early when the job gets canceled.
+func sendThem(job *SendJob) error {
+	if WhatsappCl.client == nil || !WhatsappCl.client.IsConnected() {
+		return errNotConnected
 	}
-
-	return false
-}
-func sendThem(numbers []string, message string, isfile bool, fileBytes []byte, filename string, mimitype string, c *gin.Context) bool {
-	if WhatsappCl.client != nil && WhatsappCl.client.IsConnected() {
-		var sendedMsgErr []string
-		for i, v := range numbers {
-			fmt.Printf("Number: %s, isfile: %v, filesize: %d, message: %s\n", v, isfile, len(fileBytes), message)
-			randomprim := mathrand.Perm(8)[0]
-			var Millisecond time.Duration = time.Duration(randomprim * 100000000)
-			var _message waProto.Message
-			switch {
-			case isfile && len(fileBytes) > 0:
-				if isImage(mimitype) {
-					if up, err := WhatsappCl.client.Upload(context.Background(), fileBytes, whatsmeow.MediaImage); err == nil {
-						_imagemessage := &waProto.ImageMessage{
-							Url:           &up.URL,
-							Mimetype:      proto.String(mimitype),
-							Caption:       proto.String(message),
-							FileSha256:    up.FileSHA256,
-							FileEncSha256: up.FileEncSHA256,
-							FileLength:    &up.FileLength,
-							MediaKey:      up.MediaKey,
-							DirectPath:    &up.DirectPath,
-						}
-						_message = waProto.Message{
-							ImageMessage: _imagemessage,
-						}
-					}
-				} else {
-					if up, err := WhatsappCl.client.Upload(context.Background(), fileBytes, whatsmeow.MediaDocument); err == nil {
-						_documentmessage := &waProto.DocumentMessage{
-							Url:           &up.URL,
-							Mimetype:      proto.String(mimitype),
-							Caption:       proto.String(message),
-							FileSha256:    up.FileSHA256,
-							FileName:      proto.String(filename),
-							FileEncSha256: up.FileEncSHA256,
-							FileLength:    &up.FileLength,
-							MediaKey:      up.MediaKey,
-							DirectPath:    &up.DirectPath,
-						}
-						_message = waProto.Message{
-							DocumentMessage: _documentmessage,
-						}
-					}
-
-				}
-			default:
-				_message = waProto.Message{
-					Conversation: proto.String(message),
+	// The attachments are uploaded once for every recipient
+	parts, err := buildOutgoingParts(job.content())
+	if err != nil {
+		return err
+	}
+	// what is sent is metered to the API key of the job, skipped duplicates are not
+	usage := UsageEntry{KeyID: job.KeyID, Action: UsageSend, Reference: job.ID}
+	defer func() { recordUsage(usage) }()
+	for i := range job.Recipients {
+		recipient := &job.Recipients[i]
+		if recipient.Status != RecipientPending {
+			continue
+		}
+		if jobCanceled(job.ID) {
+			return nil
+		}
+		fmt.Printf("Number: %s, attachments: %d, parts: %d, message: %s\n", recipient.Number, len(job.Attachments), len(parts), job.Message)
+		// Jobs queued before numbers were resolved only have the number
+		to := types.NewJID(recipient.Number, types.DefaultUserServer)
+		if recipient.JID != "" {
+			if jid, err := types.ParseJID(recipient.JID); err == nil {
+				to = jid
+			}
+		}
+		var sent int
+		var sendErr error
+		for _, part := range parts {
+			message, text := part.msg, ""
+			if part.text {
+				text = job.Message
+				if recipient.Message != "" {
+					text, message = recipient.Message, withText(part.msg, recipient.Message)
 				}
 			}
-			_, err := WhatsappCl.client.SendMessage(
+			// Paced by the outbound queue, a part already sent to the number recently is skipped
+			resp, err := _outbox.Send(
 				context.Background(),
-				types.NewJID(v, "s.whatsapp.net"),
-				&_message,
+				to,
+				message,
+				OutboundOptions{
+					Priority:  PriorityBulk,
+					DedupeKey: dedupeKey(recipient.Number, []byte(text), part.key, []byte(job.runKey())),
+					JobID:     job.ID,
+				},
 			)
+			if errors.Is(err, ErrOutboundCanceled) {
+				return nil
+			}
+			if errors.Is(err, ErrOutboundDuplicate) {
+				continue
+			}
 			if err != nil {
-				sendedMsgErr = append(sendedMsgErr, fmt.Errorf("%v-%v: (%v)", err, i, v).Error())
+				sendErr = err
+				break
 			}
-			fmt.Println("Number: %s, isfile: %v, filesize: %d\n", v, isfile, len(fileBytes))
-			time.Sleep(Millisecond)
-		}
-		if len(sendedMsgErr) > 0 {
-			response := ErrorResponse{
-				Reasons: sendedMsgErr,
+			// receipts are tracked on the first message sent to the recipient
+			if recipient.MessageID == "" {
+				recipient.MessageID = resp.ID
 			}
-			c.JSON(http.StatusBadRequest, response)
+			sent++
+			usage.Messages++
+			usage.MediaBytes += int64(part.size)
 		}
-	} else {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Reasons: []string{"WhatsApp client not connected!"}})
+		switch {
+		case sendErr != nil:
+			recipient.Status = RecipientFailed
+			recipient.ErrorCode = CodeSendFailed
+			recipient.Error = fmt.Errorf("%v-%v: (%v)", sendErr, i, recipient.Number).Error()
+			job.Failed++
+		case sent == 0:
+			recipient.Status = RecipientSkipped
+			recipient.ErrorCode = CodeDuplicate
+			recipient.Error = ErrOutboundDuplicate.Error()
+		default:
+			now := time.Now()
+			recipient.Status = RecipientSent
+			recipient.SentAt = &now
+			job.Sent++
+			usage.Recipients++
+		}
+		_botdb.Save(recipient)
+		_botdb.Model(job).Updates(map[string]interface{}{"sent": job.Sent, "failed": job.Failed})
+		notifyRecipient(job.ID, recipient, time.Now())
 	}
-	return true
+	return nil
 }
 
 func mainHandler(c *gin.Context) {
@@ -398,7 +438,7 @@ func generateAPIKey() (string, error) {
 	})
 
 	// Generate a symmetric key by hashing the base64-encoded modulus of the RSA public key
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&rsaKeyPair.PublicKey)
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&_keymanager.signingPrivateKey().PublicKey)
 	if err != nil {
 		return "", err
 	}
@@ -416,7 +456,7 @@ func generateAPIKey() (string, error) {
 // Function to validate the API key using public and private key logic
 func isValidAPIKey(apiKey string) bool {
 	// Generate a symmetric key by hashing the base64-encoded modulus of the RSA public key
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&rsaKeyPair.PublicKey)
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&_keymanager.signingPrivateKey().PublicKey)
 	if err != nil {
 		return false
 	}
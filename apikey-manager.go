@@ -7,6 +7,8 @@ import (
 	"html/template"
 	"io/ioutil"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoAdminGroup/go-admin/template/types"
@@ -15,19 +17,137 @@ import (
 	"gorm.io/gorm"
 )
 
+// Scopes of an API key, admin grants every scope
+const (
+	ScopeSendText     = "send:text"
+	ScopeSendMedia    = "send:media"
+	ScopeReadMessages = "read:messages"
+	ScopeGroupsManage = "groups:manage"
+	ScopeAdmin        = "admin"
+)
+
+var allScopes = []string{ScopeSendText, ScopeSendMedia, ScopeReadMessages, ScopeGroupsManage, ScopeAdmin}
+
+// defaultScopes are given to keys registered without scopes in their claims
+var defaultScopes = []string{ScopeSendText, ScopeSendMedia, ScopeReadMessages}
+
 type APIKey struct {
-	ID        uint `gorm:"primaryKey"`
-	Key       string
-	Deadline  time.Time
-	Details   string
+	ID       uint `gorm:"primaryKey"`
+	Key      string
+	Deadline time.Time
+	Details  string
+	// Scopes is the comma separated list of the scopes of the key, it is
+	// authoritative over the scopes claim of the token
+	Scopes string
+	// RateLimit is in requests per minute, DailyQuota and MonthlyQuota in
+	// messages. 0 uses the default of RATE_LIMIT, DAILY_QUOTA or
+	// MONTHLY_QUOTA, -1 is unlimited.
+	RateLimit    int
+	DailyQuota   int
+	MonthlyQuota int
+	// EventTypes and EventChats are the comma separated event types and chat
+	// JIDs the key receives from /events, every one when empty
+	EventTypes string
+	EventChats string
+	// RevokedAt is when the key stops being accepted, in the future while a
+	// rotated key overlaps with its replacement
+	RevokedAt     *time.Time
+	RevokedReason string
+	// ReplacedBy is the key issued by the rotation of this one
+	ReplacedBy uint
+	// RootID is the first key of the rotation chain of this one, 0 for the
+	// first key itself. Quotas, rate limits, usage and owned jobs and
+	// schedules are kept by the root so they follow the key across rotations.
+	RootID    uint
 	signed    string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// Root is the ID of the first key of the rotation chain of the key
+func (k *APIKey) Root() uint {
+	if k.RootID != 0 {
+		return k.RootID
+	}
+	return k.ID
+}
+
+// Revoked reports whether the key is revoked at the time
+func (k *APIKey) Revoked(at time.Time) bool {
+	return k.RevokedAt != nil && !at.Before(*k.RevokedAt)
+}
+
+// revokedError explains why a revoked key is rejected
+func (k *APIKey) revokedError() error {
+	if k.RevokedReason == "" {
+		return fmt.Errorf("API key revoked")
+	}
+	return fmt.Errorf("API key revoked: %s", k.RevokedReason)
+}
+
+// ScopeList returns the scopes of the key
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// HasScope reports whether the key grants the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopes checks the scopes and returns them in the order of allScopes
+func parseScopes(scopes []string) (string, error) {
+	granted := map[string]bool{}
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if !contains(allScopes, scope) {
+			return "", fmt.Errorf("unknown scope %q, use %s", scope, strings.Join(allScopes, ", "))
+		}
+		granted[scope] = true
+	}
+	var list []string
+	for _, scope := range allScopes {
+		if granted[scope] {
+			list = append(list, scope)
+		}
+	}
+	return strings.Join(list, ","), nil
+}
+
+// claimScopes reads the scopes claim of a token
+func claimScopes(claims jwt.MapClaims) []string {
+	values, ok := claims["scopes"].([]interface{})
+	if !ok {
+		return nil
+	}
+	var scopes []string
+	for _, value := range values {
+		if scope, ok := value.(string); ok {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
 type APIKeyManager struct {
-	db         *gorm.DB
+	db *gorm.DB
+
+	mu         sync.RWMutex
 	privateKey *rsa.PrivateKey
+	// kid of privateKey, set in the header of the tokens it signs
+	kid string
+	// publicKeys of the signing keys not retired by kid, legacyKID verifies
+	// the tokens without kid
+	publicKeys map[string]*rsa.PublicKey
+	legacyKID  string
 }
 
 func NewAPIKeyManager(db *gorm.DB, privateKeyPath string) (*APIKeyManager, error) {
@@ -41,46 +161,191 @@ func NewAPIKeyManager(db *gorm.DB, privateKeyPath string) (*APIKeyManager, error
 		return nil, err
 	}
 
-	return &APIKeyManager{
-		db:         db,
-		privateKey: privateKey,
-	}, nil
+	m := &APIKeyManager{db: db}
+	if err := m.registerSigningKey(privateKey); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
+// RemoveAPIKey revokes a key. The row is kept, /keygen would register its
+// token again otherwise.
 func (m *APIKeyManager) RemoveAPIKey(key string) error {
-	return m.db.Where("key = ?", key).Delete(&APIKey{}).Error
+	var apiKey APIKey
+	if err := m.db.Where("key = ?", key).First(&apiKey).Error; err != nil {
+		return err
+	}
+	return m.RevokeAPIKey(apiKey.ID, "removed")
 }
 
-func (m *APIKeyManager) ValidateAPIKey(tokenString string) (bool, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return &m.privateKey.PublicKey, nil
-	})
+// RevokeAPIKey stops accepting a key right away, a key already revoked keeps
+// its reason
+func (m *APIKeyManager) RevokeAPIKey(id uint, reason string) error {
+	now := time.Now()
+	result := m.db.Model(&APIKey{}).Where("id = ? AND (revoked_at IS NULL OR revoked_at > ?)", id, now).
+		Updates(map[string]interface{}{"revoked_at": now, "revoked_reason": reason})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("unknown or revoked API key %d", id)
+	}
+	var key APIKey
+	if err := m.db.First(&key, id).Error; err != nil {
+		return err
+	}
+	// the jobs and schedules of the chain stop once none of its keys is valid
+	if _, err := m.ActiveKey(key.Root()); err != nil {
+		cancelKeyWork(key.Root())
+	}
+	return nil
+}
+
+// ActiveKey returns the newest valid key of the rotation chain of the root
+func (m *APIKeyManager) ActiveKey(root uint) (*APIKey, error) {
+	var keys []APIKey
+	if err := m.db.Where("id = ? OR root_id = ?", root, root).Order("id desc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range keys {
+		if !keys[i].Revoked(now) {
+			return &keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("API key %d is revoked", root)
+}
 
+// RotateAPIKey issues a replacement of a key with the same details, scopes,
+// limits and deadline, signed with the current signing key. The old key is
+// accepted for the overlap, then revoked.
+func (m *APIKeyManager) RotateAPIKey(id uint, overlap time.Duration) (*APIKey, string, error) {
+	var old APIKey
+	if err := m.db.First(&old, id).Error; err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	if old.Revoked(now) || old.ReplacedBy != 0 {
+		return nil, "", fmt.Errorf("API key %d is revoked or already rotated", id)
+	}
+	replacement := APIKey{
+		Key:          generateRandomKey(),
+		Deadline:     old.Deadline,
+		Details:      old.Details,
+		Scopes:       old.Scopes,
+		RateLimit:    old.RateLimit,
+		DailyQuota:   old.DailyQuota,
+		MonthlyQuota: old.MonthlyQuota,
+		EventTypes:   old.EventTypes,
+		EventChats:   old.EventChats,
+		RootID:       old.Root(),
+	}
+	signed, err := m.sign(jwt.MapClaims{
+		"key":     replacement.Key,
+		"details": replacement.Details,
+		"exp":     replacement.Deadline.Unix(),
+		"scopes":  replacement.ScopeList(),
+	})
 	if err != nil {
+		return nil, "", err
+	}
+	revokedAt := now.Add(overlap)
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&replacement).Error; err != nil {
+			return err
+		}
+		return tx.Model(&old).Updates(map[string]interface{}{
+			"revoked_at":     revokedAt,
+			"revoked_reason": fmt.Sprintf("rotated, replaced by key %d", replacement.ID),
+			"replaced_by":    replacement.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &replacement, signed, nil
+}
+
+func (m *APIKeyManager) ValidateAPIKey(tokenString string) (bool, error) {
+	if _, err := m.LookupAPIKey(tokenString); err != nil {
 		return false, err
 	}
+	return true, nil
+}
+
+// LookupAPIKey validates a token and returns its key with the scopes it grants
+func (m *APIKeyManager) LookupAPIKey(tokenString string) (*APIKey, error) {
+	token, err := jwt.Parse(tokenString, m.verificationKey)
+
+	if err != nil {
+		return nil, err
+	}
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		key := claims["key"].(string)
+		key, _ := claims["key"].(string)
 		var apiKey APIKey
 		if err := m.db.Where("key = ?", key).First(&apiKey).Error; err != nil {
-			return false, err
+			return nil, err
+		}
+		if apiKey.Revoked(time.Now()) {
+			return nil, apiKey.revokedError()
 		}
 		err = token.Claims.Valid()
 		if err != nil {
 			// Handle the expiration error
-			return false, err
+			return nil, err
 		}
-		return true, nil
+		return &apiKey, nil
 	}
 
-	return false, fmt.Errorf("invalid token")
+	return nil, fmt.Errorf("invalid token")
+}
+
+// SetScopes replaces the scopes of a key, they apply to the tokens already issued
+func (m *APIKeyManager) SetScopes(id uint, scopes []string) error {
+	list, err := parseScopes(scopes)
+	if err != nil {
+		return err
+	}
+	return m.db.Model(&APIKey{}).Where("id = ?", id).Update("scopes", list).Error
+}
+
+// SetLimits replaces the rate limit and the quotas of a key
+func (m *APIKeyManager) SetLimits(id uint, rateLimit, dailyQuota, monthlyQuota int) error {
+	if rateLimit < -1 || dailyQuota < -1 || monthlyQuota < -1 {
+		return fmt.Errorf("limits must be -1 (unlimited), 0 (default) or positive")
+	}
+	return m.db.Model(&APIKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"rate_limit":    rateLimit,
+		"daily_quota":   dailyQuota,
+		"monthly_quota": monthlyQuota,
+	}).Error
+}
+
+// SetEventFilter replaces the event types and the chats a key receives from
+// /events, empty lists receive every one
+func (m *APIKeyManager) SetEventFilter(id uint, events, chats []string) error {
+	for _, event := range events {
+		if !contains(webhookEventTypes, event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	jids := make([]string, len(chats))
+	for i, chat := range chats {
+		jid, err := chatJID(chat)
+		if err != nil {
+			return fmt.Errorf("chat %q: %v", chat, err)
+		}
+		jids[i] = jid.String()
+	}
+	return m.db.Model(&APIKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"event_types": strings.Join(events, ","),
+		"event_chats": strings.Join(jids, ","),
+	}).Error
 }
 
 // ValidateNewAPIKey validates a new API key token.
 func (m *APIKeyManager) ValidateNewAPIKey(tokenString string) (bool, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return &m.privateKey.PublicKey, nil
-	})
+	token, err := jwt.Parse(tokenString, m.verificationKey)
 
 	if err != nil {
 		return false, err
@@ -101,9 +366,19 @@ func (m *APIKeyManager) ValidateNewAPIKey(tokenString string) (bool, error) {
 			// Set other APIKey fields as needed
 			apiKey.Details = "Additional details" // Example of populating the Details field
 
+			scopes := claimScopes(claims)
+			if scopes == nil {
+				scopes = defaultScopes
+			}
+			if apiKey.Scopes, err = parseScopes(scopes); err != nil {
+				return false, err
+			}
+
 			if err := m.db.Create(&apiKey).Error; err != nil {
 				return false, err
 			}
+		} else if apiKey.Revoked(time.Now()) {
+			return false, apiKey.revokedError()
 		}
 
 		err = token.Claims.Valid()
@@ -130,11 +405,15 @@ func (m *APIKeyManager) EditAPIKey(tokenString string, newDeadline time.Time) (s
 		if err := m.db.Where("key = ?", key).First(&apiKey).Error; err != nil {
 			return "", err
 		}
+		if apiKey.Revoked(time.Now()) {
+			return "", apiKey.revokedError()
+		}
 
 		apiKey.Deadline = newDeadline
 		apiKey.UpdatedAt = time.Now()
-		token = jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-		signedToken, err := token.SignedString(m.privateKey)
+		// the new token carries the scopes of the table
+		claims["scopes"] = apiKey.ScopeList()
+		signedToken, err := m.sign(claims)
 		if err != nil {
 			return "", err
 		}
@@ -147,21 +426,26 @@ func (m *APIKeyManager) EditAPIKey(tokenString string, newDeadline time.Time) (s
 
 	return "", fmt.Errorf("invalid token claims")
 }
-func (m *APIKeyManager) GenerateAPIKey(details string, deadline time.Time) (string, error) {
+func (m *APIKeyManager) GenerateAPIKey(details string, deadline time.Time, scopes []string) (string, error) {
 	var apiKey APIKey
+	list, err := parseScopes(scopes)
+	if err != nil {
+		return "", err
+	}
+	apiKey.Scopes = list
 	key := generateRandomKey()
 	claims := jwt.MapClaims{
 		"key":     key,
 		"details": details,
 		"exp":     deadline.Unix(),
+		"scopes":  apiKey.ScopeList(),
 	}
 	apiKey.Deadline = deadline
 	apiKey.UpdatedAt = time.Now()
 	apiKey.Details = details
 	apiKey.Key = key
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	signedToken, err := token.SignedString(m.privateKey)
+	signedToken, err := m.sign(claims)
 	if err != nil {
 		return "", err
 	}
@@ -209,10 +493,16 @@ func init_apikeymanager() (*APIKeyManager, error) {
 		log.Fatal(err)
 	}
 
-	// Auto-migrate the APIKey model
-	if err := db.AutoMigrate(&APIKey{}); err != nil {
+	// Keys created before scopes keep the access they had to every route
+	legacy := !db.Migrator().HasColumn(&APIKey{}, "scopes")
+
+	// Auto-migrate the APIKey and SigningKey models
+	if err := db.AutoMigrate(&APIKey{}, &SigningKey{}); err != nil {
 		log.Fatal(err)
 	}
+	if legacy {
+		db.Model(&APIKey{}).Where("1 = 1").Update("scopes", strings.Join(allScopes, ","))
+	}
 
 	// Create a new APIKeyManager
 	return NewAPIKeyManager(db, privateKeyPath)
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeyRevoked(t *testing.T) {
+	now := time.Date(2023, 7, 14, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		revokedAt := now.Add(d)
+		return &revokedAt
+	}
+	tests := []struct {
+		name      string
+		revokedAt *time.Time
+		want      bool
+	}{
+		{name: "not revoked"},
+		{name: "revoked", revokedAt: at(-time.Hour), want: true},
+		{name: "revoked now", revokedAt: at(0), want: true},
+		{name: "rotated, in the overlap", revokedAt: at(time.Hour)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := &APIKey{RevokedAt: test.revokedAt}
+			if got := key.Revoked(now); got != test.want {
+				t.Fatalf("Revoked = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
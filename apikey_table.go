@@ -1,32 +1,238 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/GoAdminGroup/go-admin/context"
-	"github.com/GoAdminGroup/go-admin/modules/db"
-	"github.com/GoAdminGroup/go-admin/plugins/admin/modules/table"
-	"github.com/GoAdminGroup/go-admin/template"
 	"github.com/GoAdminGroup/go-admin/template/types"
-	editType "github.com/GoAdminGroup/go-admin/template/types/table"
 )
 
+// GetKeytable lists the API keys and the signing keys, the scopes, the limits
+// and the revocation of each key are edited in place
 func GetKeytable(ctx *context.Context) (types.Panel, error) {
-	api_keys := table.NewDefaultTable(table.DefaultConfigWithDriverAndConnection("sqlite", "apikeys"))
-	info := api_keys.GetInfo()
-	info.AddField("ID", "id", db.Int).FieldSortable()
-	info.AddField("Key", "key", db.Varchar).FieldDisplay(func(value types.FieldModel) interface{} {
-		return template.Default().
-			Link().
-			SetURL("/info/keys?__goadmin_detail_pk=" + value.Value).
-			SetContent(template.HTML(value.Value)).
-			OpenInNewTab().
-			SetTabTitle(template.HTML("Key Detail(" + value.Value + ")")).
-			GetContent()
-	}).FieldSortable()
-	info.AddField("Details", "details", db.Varchar).FieldEditAble(editType.Textarea).FieldSortable()
-	info.AddField("Deadline", "deadline", db.Date).FieldSortable()
-	info.SetTable("keys").SetTitle("Keys").SetDescription("Keys Management")
+	var keys []APIKey
+	if err := _keymanager.db.Order("id").Find(&keys).Error; err != nil {
+		return types.Panel{}, err
+	}
+	var content strings.Builder
+	if message := ctx.Query("error"); message != "" {
+		content.WriteString(fmt.Sprintf("<div class=\"alert alert-danger\">%s</div>", template.HTMLEscapeString(message)))
+	}
+	csrf := csrfField(_adminTokens.AddToken())
+	content.WriteString("<table class=\"table table-bordered\"><tr><th>ID</th><th>Key</th><th>Details</th><th>Deadline</th><th>Scopes</th><th>Limits</th><th>Events</th><th>Status</th></tr>")
+	now := time.Now()
+	for _, key := range keys {
+		var scopes strings.Builder
+		for _, scope := range allScopes {
+			checked := ""
+			if contains(key.ScopeList(), scope) {
+				checked = " checked"
+			}
+			scopes.WriteString(fmt.Sprintf("<label class=\"checkbox-inline\"><input type=\"checkbox\" name=\"scope\" value=\"%s\"%s> %s</label>", scope, checked, scope))
+		}
+		short := key.Key
+		if len(short) > 12 {
+			short = short[:12] + "…"
+		}
+		content.WriteString(fmt.Sprintf(`<tr><td>%d</td><td><code>%s</code></td><td>%s</td><td>%s</td><td><form method="post" action="/admin/keys/scopes">%s
+<input type="hidden" name="id" value="%d">%s <button type="submit" class="btn btn-xs btn-primary">Save</button></form></td>
+<td><form method="post" action="/admin/keys/limits" class="form-inline">%s<input type="hidden" name="id" value="%d">
+<input class="form-control input-sm" type="number" min="-1" name="rate_limit" value="%d" title="Requests per minute" style="width:6em">
+<input class="form-control input-sm" type="number" min="-1" name="daily_quota" value="%d" title="Messages per day" style="width:6em">
+<input class="form-control input-sm" type="number" min="-1" name="monthly_quota" value="%d" title="Messages per month" style="width:6em">
+<button type="submit" class="btn btn-xs btn-primary">Save</button></form></td>
+<td><form method="post" action="/admin/keys/events">%s<input type="hidden" name="id" value="%d">
+<input class="form-control input-sm" name="events" value="%s" placeholder="All events" title="Comma separated event types">
+<input class="form-control input-sm" name="chats" value="%s" placeholder="All chats" title="Comma separated chat JIDs or numbers">
+<button type="submit" class="btn btn-xs btn-primary">Save</button></form></td><td>%s</td></tr>`,
+			key.ID, template.HTMLEscapeString(short), template.HTMLEscapeString(key.Details), key.Deadline.Format(time.RFC3339), csrf, key.ID, scopes.String(),
+			csrf, key.ID, key.RateLimit, key.DailyQuota, key.MonthlyQuota,
+			csrf, key.ID, template.HTMLEscapeString(key.EventTypes), template.HTMLEscapeString(key.EventChats), keyStatus(&key, now, csrf)))
+	}
+	content.WriteString("</table><p class=\"help-block\">Limits are requests per minute, messages per day and messages per month, 0 uses the default and -1 is unlimited. Events are the event types and the chats the key receives from /events.</p>")
+
+	current := _keymanager.currentKID()
+	content.WriteString(fmt.Sprintf(`<h4>Signing keys</h4><form method="post" action="/admin/keys/signing/rotate">%s<button type="submit" class="btn btn-primary">Rotate the signing key</button>
+<p class="help-block">A new private_key.pem signs the new tokens, the tokens of the previous key are accepted until it is retired.</p></form>`, csrf))
+	content.WriteString("<table class=\"table table-bordered\"><tr><th>kid</th><th>Created</th><th>Status</th></tr>")
+	for _, signing := range _keymanager.signingKeys() {
+		status := "Accepted"
+		switch {
+		case signing.RetiredAt != nil:
+			status = "Retired " + signing.RetiredAt.Format(time.RFC3339)
+		case signing.KID == current:
+			status = "Current"
+		default:
+			status += fmt.Sprintf(` <form method="post" action="/admin/keys/signing/retire" style="display:inline">%s<input type="hidden" name="kid" value="%s">
+<button type="submit" class="btn btn-xs btn-danger">Retire</button></form>`, csrf, signing.KID)
+		}
+		if signing.Legacy {
+			status += " (tokens without kid)"
+		}
+		content.WriteString(fmt.Sprintf("<tr><td><code>%s</code></td><td>%s</td><td>%s</td></tr>", signing.KID, signing.CreatedAt.Format(time.RFC3339), status))
+	}
+	content.WriteString("</table>")
+	return types.Panel{
+		Content:     template.HTML(content.String()),
+		Title:       "Keys",
+		Description: "API keys, their scopes, limits and signing keys",
+	}, nil
+}
+
+// keyStatus shows whether a key is revoked, with the forms revoking and rotating it
+func keyStatus(key *APIKey, now time.Time, csrf string) string {
+	if key.Revoked(now) {
+		return fmt.Sprintf("Revoked %s<br>%s", key.RevokedAt.Format(time.RFC3339), template.HTMLEscapeString(key.RevokedReason))
+	}
+	var status strings.Builder
+	if key.RevokedAt != nil {
+		status.WriteString(fmt.Sprintf("Replaced by key %d, accepted until %s<br>", key.ReplacedBy, key.RevokedAt.Format(time.RFC3339)))
+	} else {
+		status.WriteString(fmt.Sprintf(`<form method="post" action="/admin/keys/rotate" class="form-inline">%s<input type="hidden" name="id" value="%d">
+<input class="form-control input-sm" name="overlap" value="24h" title="How long the key is still accepted" style="width:5em">
+<button type="submit" class="btn btn-xs btn-default">Rotate</button></form>`, csrf, key.ID))
+	}
+	status.WriteString(fmt.Sprintf(`<form method="post" action="/admin/keys/revoke" class="form-inline">%s<input type="hidden" name="id" value="%d">
+<input class="form-control input-sm" name="reason" placeholder="Reason" style="width:8em">
+<button type="submit" class="btn btn-xs btn-danger">Revoke</button></form>`, csrf, key.ID))
+	return status.String()
+}
+
+// revokeKeyForm revokes a key from the admin panel
+func revokeKeyForm(ctx *context.Context) {
+	location := "/admin/info/keys"
+	id, err := strconv.ParseUint(ctx.FormValue("id"), 10, 64)
+	if err == nil {
+		err = checkCSRF(ctx)
+	}
+	if err == nil {
+		reason := ctx.FormValue("reason")
+		if reason == "" {
+			reason = "revoked in the admin"
+		}
+		err = _keymanager.RevokeAPIKey(uint(id), reason)
+	}
+	if err != nil {
+		location += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
+
+// rotateKeyPanel rotates a key and shows its replacement, the only time its token is shown
+func rotateKeyPanel(ctx *context.Context) (types.Panel, error) {
+	if err := checkCSRF(ctx); err != nil {
+		return types.Panel{}, err
+	}
+	id, err := strconv.ParseUint(ctx.FormValue("id"), 10, 64)
+	if err != nil {
+		return types.Panel{}, fmt.Errorf("invalid key id %q", ctx.FormValue("id"))
+	}
+	overlap, err := parseKeyOverlap(ctx.FormValue("overlap"))
+	if err != nil {
+		return types.Panel{}, fmt.Errorf("overlap %v", err)
+	}
+	replacement, signed, err := _keymanager.RotateAPIKey(uint(id), overlap)
+	if err != nil {
+		return types.Panel{}, err
+	}
+	content := fmt.Sprintf(`<p>Key %d is replaced by key %d and is accepted until %s. The new token is only shown once:</p>
+<pre style="white-space:pre-wrap;word-break:break-all">%s</pre><a class="btn btn-default" href="/admin/info/keys">Back to the keys</a>`,
+		id, replacement.ID, time.Now().Add(overlap).Format(time.RFC3339), template.HTMLEscapeString(signed))
 	return types.Panel{
-		Content:     "<span class=\"logo-lg\"><b>Go</b>Admin</span>",
-		Description: "Keys Management",
+		Content:     template.HTML(content),
+		Title:       "Keys",
+		Description: "Rotated API key",
 	}, nil
 }
+
+// rotateSigningKeyForm rolls private_key.pem from the admin panel
+func rotateSigningKeyForm(ctx *context.Context) {
+	location := "/admin/info/keys"
+	err := checkCSRF(ctx)
+	if err == nil {
+		_, err = _keymanager.RotateSigningKey()
+	}
+	if err != nil {
+		location += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
+
+// retireSigningKeyForm stops accepting the tokens of a signing key
+func retireSigningKeyForm(ctx *context.Context) {
+	location := "/admin/info/keys"
+	err := checkCSRF(ctx)
+	if err == nil {
+		err = _keymanager.RetireSigningKey(ctx.FormValue("kid"))
+	}
+	if err != nil {
+		location += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
+
+// saveKeyScopesForm replaces the scopes of a key with the ones checked in the admin panel
+func saveKeyScopesForm(ctx *context.Context) {
+	location := "/admin/info/keys"
+	id, err := strconv.ParseUint(ctx.FormValue("id"), 10, 64)
+	if err == nil {
+		err = checkCSRF(ctx)
+	}
+	if err == nil {
+		err = _keymanager.SetScopes(uint(id), ctx.Request.Form["scope"])
+	}
+	if err != nil {
+		location += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
+
+// saveKeyLimitsForm replaces the rate limit and the quotas of a key
+func saveKeyLimitsForm(ctx *context.Context) {
+	location := "/admin/info/keys"
+	var values []int
+	var err error
+	for _, name := range []string{"id", "rate_limit", "daily_quota", "monthly_quota"} {
+		var value int
+		if value, err = strconv.Atoi(ctx.FormValue(name)); err != nil {
+			err = fmt.Errorf("%s must be a number", name)
+			break
+		}
+		values = append(values, value)
+	}
+	if err == nil {
+		err = checkCSRF(ctx)
+	}
+	if err == nil {
+		err = _keymanager.SetLimits(uint(values[0]), values[1], values[2], values[3])
+	}
+	if err != nil {
+		location += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
+
+// saveKeyEventsForm replaces the event types and the chats a key receives from /events
+func saveKeyEventsForm(ctx *context.Context) {
+	location := "/admin/info/keys"
+	list := func(name string) []string {
+		return strings.FieldsFunc(ctx.FormValue(name), func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	id, err := strconv.ParseUint(ctx.FormValue("id"), 10, 64)
+	if err == nil {
+		err = checkCSRF(ctx)
+	}
+	if err == nil {
+		err = _keymanager.SetEventFilter(uint(id), list("events"), list("chats"))
+	}
+	if err != nil {
+		location += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
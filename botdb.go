@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Database holding the bot state (chat settings, history, jobs...)
+const botDBPath = "bot.db"
+
+var _botdb *gorm.DB
+
+// botModels lists every model auto-migrated into the bot database
+var botModels = []interface{}{
+	&ChatSetting{},
+	&Answer{},
+	&SendJob{},
+	&JobRecipient{},
+	&OutboundMessage{},
+	&WebhookSubscription{},
+	&WebhookDelivery{},
+	&PhoneLookup{},
+	&MessageTemplate{},
+	&Schedule{},
+	&Attachment{},
+	&ChatMessage{},
+	&Chat{},
+	&StoredMedia{},
+	&StreamEvent{},
+	&IdempotencyRecord{},
+	&QuotaCounter{},
+	&UsageEntry{},
+}
+
+func init_botdb() *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(botDBPath), &gorm.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Auto-migrate the bot models
+	if err := db.AutoMigrate(botModels...); err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
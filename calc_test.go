@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestEvalExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+		wantErr    bool
+	}{
+		{expression: "1+2*3", want: 7},
+		{expression: "(1+2)*3", want: 9},
+		{expression: " 10 - 4 - 3 ", want: 3},
+		{expression: "7/2", want: 3.5},
+		{expression: "10%4", want: 2},
+		{expression: "2^3^2", want: 512},
+		{expression: "2^-1", want: 0.5},
+		{expression: "-3+5", want: 2},
+		{expression: "--3", want: 3},
+		{expression: "1.5*4", want: 6},
+		{expression: "", wantErr: true},
+		{expression: "1/0", wantErr: true},
+		{expression: "5%0", wantErr: true},
+		{expression: "(1+2", wantErr: true},
+		{expression: "1+", wantErr: true},
+		{expression: "2*x", wantErr: true},
+		{expression: "1)", wantErr: true},
+		{expression: "1.2.3", wantErr: true},
+		{expression: "(-8)^0.5", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			got, err := evalExpression(test.expression)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("evalExpression(%q) = %v, want an error", test.expression, got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("evalExpression(%q) = %v, %v, want %v", test.expression, got, err, test.want)
+			}
+		})
+	}
+}
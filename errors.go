@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Stable error codes of the API, clients should match on them rather than on messages
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodeDisconnected   = "whatsapp_disconnected"
+	CodeInternal       = "internal_error"
+
+	// CodeRateLimited and CodeQuotaExceeded are returned with 429 and Retry-After
+	CodeRateLimited   = "rate_limited"
+	CodeQuotaExceeded = "quota_exceeded"
+
+	// CodeIdempotencyMismatch is returned when an Idempotency-Key is reused with another body
+	CodeIdempotencyMismatch = "idempotency_key_reused"
+
+	// codes of the recipients of a job
+	CodeSendFailed = "send_failed"
+	CodeDuplicate  = "duplicate"
+)
+
+// errNotConnected is returned when a job starts while the WhatsApp client is disconnected
+var errNotConnected = errors.New("WhatsApp client not connected!")
+
+// RequestIDHeader carries the ID of a request, echoed in every response
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what a client provided request ID may look like, others are replaced
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// ErrorResponse is the body of every error of the API
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Error     string      `json:"error"`
+	Fields    FieldErrors `json:"fields,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// requestID reuses the X-Request-ID of the client or generates one, and
+// echoes it in the response headers
+func requestID(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.NewString()
+	}
+	c.Set(RequestIDHeader, id)
+	c.Header(RequestIDHeader, id)
+	c.Next()
+}
+
+// abortWithError ends the request with the error body
+func abortWithError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Code:      code,
+		Error:     message,
+		RequestID: c.GetString(RequestIDHeader),
+	})
+}
+
+// abortWithFields ends the request with the fields that do not validate
+func abortWithFields(c *gin.Context, errs FieldErrors) {
+	c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+		Code:      CodeInvalidRequest,
+		Error:     "Invalid request body",
+		Fields:    errs,
+		RequestID: c.GetString(RequestIDHeader),
+	})
+}
+
+// errorCode returns the code of an error that ended a job
+func errorCode(err error) string {
+	if errors.Is(err, errNotConnected) {
+		return CodeDisconnected
+	}
+	return CodeSendFailed
+}
+
+// apiKeyContextKey holds the *APIKey of the request, set by authenticate
+const apiKeyContextKey = "api_key"
+
+// requestAPIKey returns the key that authenticated the request
+func requestAPIKey(c *gin.Context) *APIKey {
+	key, _ := c.Get(apiKeyContextKey)
+	apiKey, _ := key.(*APIKey)
+	return apiKey
+}
+
+// ownsResource reports whether the API key of the request created a job or a
+// schedule, admin keys see those of every key
+func ownsResource(c *gin.Context, keyID uint) bool {
+	key := requestAPIKey(c)
+	return key != nil && (key.Root() == keyID || key.HasScope(ScopeAdmin))
+}
+
+// requireScope ends the request with 403 when the API key lacks the scope
+func requireScope(c *gin.Context, scope string) bool {
+	if key := requestAPIKey(c); key == nil || !key.HasScope(scope) {
+		abortWithError(c, http.StatusForbidden, CodeForbidden, fmt.Sprintf("The API key lacks the %s scope", scope))
+		return false
+	}
+	return true
+}
+
+// requireConnection ends the request with 503 when the WhatsApp client is not connected
+func requireConnection(c *gin.Context) bool {
+	if WhatsappCl.client == nil || !WhatsappCl.client.IsConnected() {
+		abortWithError(c, http.StatusServiceUnavailable, CodeDisconnected, errNotConnected.Error())
+		return false
+	}
+	return true
+}
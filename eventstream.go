@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultEventRetention is how long events are kept to resume a stream, see EVENTS_RETENTION
+	defaultEventRetention = 24 * time.Hour
+	// streamBuffer is how many live events a slow client may lag behind before it is disconnected
+	streamBuffer = 256
+	// streamHeartbeat keeps idle connections open through proxies
+	streamHeartbeat = 25 * time.Second
+)
+
+// StreamEvent is an event of the /events stream, stored so that clients can
+// resume from the last event they received
+type StreamEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	Event     string    `gorm:"index"`
+	Chat      string    `gorm:"index"`
+	Payload   []byte    // the JSON of the event data
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// frame is the JSON sent to clients, the same envelope as webhooks with the
+// sequence number of the event as ID
+func (e *StreamEvent) frame() WebhookEvent {
+	return WebhookEvent{
+		ID:        strconv.FormatUint(uint64(e.ID), 10),
+		Event:     e.Event,
+		Timestamp: e.CreatedAt,
+		Data:      json.RawMessage(e.Payload),
+	}
+}
+
+// streamFilter selects the events a client wants among those its API key receives
+type streamFilter struct {
+	events map[string]bool
+	chat   string
+	// keyEvents and keyChats are the event types and chats of the key, all when empty
+	keyEvents map[string]bool
+	keyChats  map[string]bool
+}
+
+func (f streamFilter) wants(e *StreamEvent) bool {
+	if len(f.events) > 0 && !f.events[e.Event] || len(f.keyEvents) > 0 && !f.keyEvents[e.Event] {
+		return false
+	}
+	if len(f.keyChats) > 0 && !f.keyChats[e.Chat] {
+		return false
+	}
+	return f.chat == "" || f.chat == e.Chat
+}
+
+func stringSet(items []string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// EventList is the event types the key receives, empty for all of them
+func (k *APIKey) EventList() []string {
+	return splitList(k.EventTypes)
+}
+
+// ChatList is the chats the key receives the events of, empty for all of them
+func (k *APIKey) ChatList() []string {
+	return splitList(k.EventChats)
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+// eventHub broadcasts the events to the connected clients
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan *StreamEvent]bool
+}
+
+var _eventHub = &eventHub{clients: map[chan *StreamEvent]bool{}}
+
+func (h *eventHub) subscribe() chan *StreamEvent {
+	ch := make(chan *StreamEvent, streamBuffer)
+	h.mu.Lock()
+	h.clients[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *StreamEvent) {
+	h.mu.Lock()
+	if h.clients[ch] {
+		delete(h.clients, ch)
+		close(ch)
+	}
+	h.mu.Unlock()
+}
+
+// broadcast sends the event to every client, a client whose buffer is full
+// is disconnected and has to resume from its last event
+func (h *eventHub) broadcast(e *StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishEvent stores the whatsmeow event and sends it to the stream clients
+func publishEvent(evt interface{}) {
+	event, data, ok := webhookPayload(evt)
+	if !ok || _botdb == nil {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("Event stream error: %v\n", err)
+		return
+	}
+	stored := &StreamEvent{Event: event, Payload: payload}
+	if message, ok := data.(IncomingMessage); ok {
+		stored.Chat = message.Chat
+	} else if fields, ok := data.(gin.H); ok {
+		stored.Chat, _ = fields["chat"].(string)
+	}
+	if err := _botdb.Create(stored).Error; err != nil {
+		fmt.Printf("Event stream error: %v\n", err)
+		return
+	}
+	_eventHub.broadcast(stored)
+}
+
+// startEventPruner deletes the events older than the retention
+func startEventPruner() {
+	go func() {
+		for {
+			retention := envDuration(EventsRetentionEnvVar, defaultEventRetention)
+			_botdb.Where("created_at < ?", time.Now().Add(-retention)).Delete(&StreamEvent{})
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// parseStreamFilter reads the events and chat query parameters, they must be
+// among the events and chats of the API key
+func parseStreamFilter(c *gin.Context) (streamFilter, FieldErrors) {
+	key := requestAPIKey(c)
+	filter := streamFilter{events: map[string]bool{}, keyEvents: stringSet(key.EventList()), keyChats: stringSet(key.ChatList())}
+	for _, value := range c.QueryArray("events") {
+		for _, event := range strings.Split(value, ",") {
+			if event = strings.TrimSpace(event); event == "" || event == "*" {
+				continue
+			}
+			if !contains(webhookEventTypes, event) {
+				return filter, FieldErrors{"events": fmt.Sprintf("unknown event %q, use one of %s", event, strings.Join(webhookEventTypes, ", "))}
+			}
+			if len(filter.keyEvents) > 0 && !filter.keyEvents[event] {
+				return filter, FieldErrors{"events": fmt.Sprintf("the API key does not receive %s events", event)}
+			}
+			filter.events[event] = true
+		}
+	}
+	if chat := c.Query("chat"); chat != "" {
+		jid, err := chatJID(chat)
+		if err != nil {
+			return filter, FieldErrors{"chat": err.Error()}
+		}
+		filter.chat = jid.String()
+		if len(filter.keyChats) > 0 && !filter.keyChats[filter.chat] {
+			return filter, FieldErrors{"chat": "the API key does not receive the events of this chat"}
+		}
+	}
+	return filter, nil
+}
+
+// lastEventID is where a client resumes, from the Last-Event-ID header sent
+// by EventSource on reconnection or the last_event_id parameter
+func lastEventID(c *gin.Context) (uint, error) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	return uint(id), err
+}
+
+// streamWriter writes events to one client
+type streamWriter interface {
+	write(e *StreamEvent) error
+	heartbeat() error
+}
+
+// sseWriter writes Server-Sent Events
+type sseWriter struct {
+	c *gin.Context
+}
+
+func (w sseWriter) write(e *StreamEvent) error {
+	body, err := json.Marshal(e.frame())
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w.c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Event, body); err != nil {
+		return err
+	}
+	w.c.Writer.Flush()
+	return nil
+}
+
+func (w sseWriter) heartbeat() error {
+	if _, err := fmt.Fprint(w.c.Writer, ": ping\n\n"); err != nil {
+		return err
+	}
+	w.c.Writer.Flush()
+	return nil
+}
+
+// wsWriter writes JSON text messages to a WebSocket
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (w wsWriter) write(e *StreamEvent) error {
+	w.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return w.conn.WriteJSON(e.frame())
+}
+
+func (w wsWriter) heartbeat() error {
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// the API key authenticates the client, whatever its origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamEvents replays the stored events after the last event ID, then
+// writes the live events until the client goes away
+func streamEvents(w streamWriter, filter streamFilter, after uint, done <-chan struct{}) {
+	// subscribed before the replay so no event falls between the two
+	live := _eventHub.subscribe()
+	defer _eventHub.unsubscribe(live)
+
+	if after > 0 {
+		var missed []StreamEvent
+		_botdb.Where("id > ?", after).Order("id").Find(&missed)
+		for i := range missed {
+			if !filter.wants(&missed[i]) {
+				continue
+			}
+			if err := w.write(&missed[i]); err != nil {
+				return
+			}
+			after = missed[i].ID
+		}
+	}
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				return
+			}
+			if e.ID <= after || !filter.wants(e) {
+				continue
+			}
+			if err := w.write(e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := w.heartbeat(); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Handler function streaming the events over a WebSocket, or as Server-Sent
+// Events for other requests
+func eventsHandler(c *gin.Context) {
+	filter, errs := parseStreamFilter(c)
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+	after, err := lastEventID(c)
+	if err != nil {
+		abortWithFields(c, FieldErrors{"last_event_id": "must be the id of an event"})
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the client sends nothing, reading detects when it goes away
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		streamEvents(wsWriter{conn: conn}, filter, after, done)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	streamEvents(sseWriter{c: c}, filter, after, c.Request.Context().Done())
+}
+
+// apiKeyFromQuery lets clients that cannot set headers, like the browser
+// EventSource and WebSocket, pass their API key as the api_key parameter
+func apiKeyFromQuery(c *gin.Context) {
+	if c.GetHeader("X-API-Key") == "" && c.Query("api_key") != "" {
+		c.Request.Header.Set("X-API-Key", c.Query("api_key"))
+	}
+	c.Next()
+}
+
+// redactedLogFormatter is the access log line of gin with the value of the
+// api_key parameter hidden
+func redactedLogFormatter(param gin.LogFormatterParams) string {
+	if u, err := url.Parse(param.Path); err == nil && u.Query().Get("api_key") != "" {
+		query := u.Query()
+		query.Set("api_key", "REDACTED")
+		u.RawQuery = query.Encode()
+		param.Path = u.String()
+	}
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor, methodColor, resetColor = param.StatusCodeColor(), param.MethodColor(), param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoAdminGroup/go-admin/context"
+	"github.com/GoAdminGroup/go-admin/template/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Answer stores a prompt/response pair sent by the bot and the reaction it got
+type Answer struct {
+	ID        uint   `gorm:"primaryKey"`
+	MessageID string `gorm:"uniqueIndex"`
+	Chat      string
+	User      string
+	Prompt    string
+	Response  string
+	Reaction  string
+	Rating    int
+	RatedAt   *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Reactions counted as good or bad feedback, any other emoji is neutral
+var (
+	positiveReactions = []string{"👍", "❤️", "❤", "🙏", "👏", "😍", "🔥", "✅", "💯"}
+	negativeReactions = []string{"👎", "😡", "😠", "❌", "🤦", "😢", "💩"}
+)
+
+// ratingOf maps a reaction emoji to +1, -1 or 0
+func ratingOf(reaction string) int {
+	reaction = strings.TrimSpace(reaction)
+	switch {
+	case contains(positiveReactions, reaction):
+		return 1
+	case contains(negativeReactions, reaction):
+		return -1
+	}
+	return 0
+}
+
+// recordAnswer stores a prompt/response pair sent as the message id
+func recordAnswer(messageID string, v *events.Message, prompt string, response string) {
+	if _botdb == nil || messageID == "" {
+		return
+	}
+	answer := Answer{
+		MessageID: messageID,
+		Chat:      v.Info.Chat.String(),
+		User:      v.Info.Sender.String(),
+		Prompt:    prompt,
+		Response:  response,
+	}
+	if err := _botdb.Create(&answer).Error; err != nil {
+		fmt.Printf("Answer record error: %v\n", err)
+	}
+}
+
+// recordReaction attaches a reaction event to the answer it targets.
+// Reactions to messages that are not stored answers are ignored, an empty
+// reaction means it was removed.
+func recordReaction(v *events.Message) {
+	reaction := v.Message.GetReactionMessage()
+	if _botdb == nil || reaction == nil {
+		return
+	}
+	var answer Answer
+	if err := _botdb.Where("message_id = ?", reaction.GetKey().GetId()).First(&answer).Error; err != nil {
+		return
+	}
+	answer.Reaction = reaction.GetText()
+	answer.Rating = ratingOf(answer.Reaction)
+	answer.RatedAt = nil
+	if answer.Reaction != "" {
+		answer.RatedAt = &v.Info.Timestamp
+	}
+	if err := _botdb.Save(&answer).Error; err != nil {
+		fmt.Printf("Reaction record error: %v\n", err)
+	}
+}
+
+// FeedbackStats aggregates the ratings of the stored answers
+type FeedbackStats struct {
+	Answers   int64
+	Rated     int64
+	Positive  int64
+	Negative  int64
+	Reactions map[string]int64
+}
+
+// Satisfaction is the share of positive ratings among the non-neutral ones
+func (s FeedbackStats) Satisfaction() float64 {
+	if s.Positive+s.Negative == 0 {
+		return 0
+	}
+	return float64(s.Positive) / float64(s.Positive+s.Negative) * 100
+}
+
+func getFeedbackStats() (FeedbackStats, error) {
+	stats := FeedbackStats{Reactions: map[string]int64{}}
+	if err := _botdb.Model(&Answer{}).Count(&stats.Answers).Error; err != nil {
+		return stats, err
+	}
+	_botdb.Model(&Answer{}).Where("reaction <> ''").Count(&stats.Rated)
+	_botdb.Model(&Answer{}).Where("rating > 0").Count(&stats.Positive)
+	_botdb.Model(&Answer{}).Where("rating < 0").Count(&stats.Negative)
+	rows, err := _botdb.Model(&Answer{}).Select("reaction, count(*)").Where("reaction <> ''").Group("reaction").Rows()
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reaction string
+		var count int64
+		if err := rows.Scan(&reaction, &count); err != nil {
+			return stats, err
+		}
+		stats.Reactions[reaction] = count
+	}
+	return stats, nil
+}
+
+// GetFeedbackPanel renders the answer quality stats in the admin panel
+func GetFeedbackPanel(ctx *context.Context) (types.Panel, error) {
+	stats, err := getFeedbackStats()
+	if err != nil {
+		return types.Panel{}, err
+	}
+	var content strings.Builder
+	content.WriteString("<table class=\"table table-bordered\">")
+	content.WriteString(fmt.Sprintf("<tr><th>Answers</th><td>%d</td></tr>", stats.Answers))
+	content.WriteString(fmt.Sprintf("<tr><th>Rated</th><td>%d</td></tr>", stats.Rated))
+	content.WriteString(fmt.Sprintf("<tr><th>Positive</th><td>%d</td></tr>", stats.Positive))
+	content.WriteString(fmt.Sprintf("<tr><th>Negative</th><td>%d</td></tr>", stats.Negative))
+	content.WriteString(fmt.Sprintf("<tr><th>Satisfaction</th><td>%.1f%%</td></tr>", stats.Satisfaction()))
+	for reaction, count := range stats.Reactions {
+		content.WriteString(fmt.Sprintf("<tr><th>%s</th><td>%d</td></tr>", template.HTMLEscapeString(reaction), count))
+	}
+	content.WriteString("</table>")
+	content.WriteString("<a class=\"btn btn-primary\" href=\"/admin/feedback/export\">Export rated pairs (JSONL)</a>")
+	return types.Panel{
+		Content:     template.HTML(content.String()),
+		Title:       "Feedback",
+		Description: "Answers quality",
+	}, nil
+}
+
+// feedbackSample is one line of the exported dataset
+type feedbackSample struct {
+	Prompt   string `json:"prompt"`
+	Response string `json:"response"`
+	Reaction string `json:"reaction"`
+	Rating   int    `json:"rating"`
+}
+
+// exportFeedback streams the rated pairs as JSONL, ?rating=positive|negative filters them
+func exportFeedback(ctx *context.Context) {
+	query := _botdb.Where("reaction <> ''")
+	switch ctx.Query("rating") {
+	case "positive":
+		query = query.Where("rating > 0")
+	case "negative":
+		query = query.Where("rating < 0")
+	}
+	var answers []Answer
+	if err := query.Order("id").Find(&answers).Error; err != nil {
+		ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	var body strings.Builder
+	encoder := json.NewEncoder(&body)
+	for _, answer := range answers {
+		encoder.Encode(feedbackSample{
+			Prompt:   answer.Prompt,
+			Response: answer.Response,
+			Reaction: answer.Reaction,
+			Rating:   answer.Rating,
+		})
+	}
+	ctx.DataWithHeaders(http.StatusOK, map[string]string{
+		"Content-Type":        "application/x-ndjson",
+		"Content-Disposition": "attachment; filename=\"feedback.jsonl\"",
+	}, []byte(body.String()))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// GroupParticipant is a member of a group listed by /groups
+type GroupParticipant struct {
+	JID          string `json:"jid"`
+	IsAdmin      bool   `json:"is_admin"`
+	IsSuperAdmin bool   `json:"is_super_admin"`
+}
+
+// Group is a group the bot belongs to, as listed by /groups
+type Group struct {
+	JID          string             `json:"jid"`
+	Name         string             `json:"name"`
+	Topic        string             `json:"topic,omitempty"`
+	Announce     bool               `json:"announce"`
+	Locked       bool               `json:"locked"`
+	Participants []GroupParticipant `json:"participants"`
+}
+
+func newGroup(info *types.GroupInfo) Group {
+	group := Group{
+		JID:          info.JID.String(),
+		Name:         info.Name,
+		Topic:        info.Topic,
+		Announce:     info.IsAnnounce,
+		Locked:       info.IsLocked,
+		Participants: make([]GroupParticipant, len(info.Participants)),
+	}
+	for i, participant := range info.Participants {
+		group.Participants[i] = GroupParticipant{
+			JID:          participant.JID.String(),
+			IsAdmin:      participant.IsAdmin,
+			IsSuperAdmin: participant.IsSuperAdmin,
+		}
+	}
+	return group
+}
+
+// isGroupTarget reports whether a recipient names a group rather than a phone number
+func isGroupTarget(target string) bool {
+	target = strings.TrimSpace(target)
+	return strings.HasSuffix(target, "@"+types.GroupServer) || strings.HasPrefix(target, whatsmeow.InviteLinkPrefix)
+}
+
+// groupResolver resolves the groups of one request, the joined groups are
+// fetched once and only when needed
+type groupResolver struct {
+	joined []*types.GroupInfo
+}
+
+func (r *groupResolver) joinedGroups() ([]*types.GroupInfo, error) {
+	if r.joined != nil {
+		return r.joined, nil
+	}
+	groups, err := WhatsappCl.client.GetJoinedGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the joined groups: %v", err)
+	}
+	r.joined = groups
+	return groups, nil
+}
+
+func (r *groupResolver) isJoined(jid types.JID) (bool, error) {
+	groups, err := r.joinedGroups()
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groups {
+		if group.JID == jid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resolve returns the JID of a group given by JID, invite link or name, and
+// the invite link to join when the bot is not a member of its group yet. A
+// group given by JID or name has to be joined already.
+func (r *groupResolver) resolve(target string) (types.JID, string, error) {
+	target = strings.TrimSpace(target)
+	switch {
+	case strings.HasPrefix(target, whatsmeow.InviteLinkPrefix):
+		info, err := WhatsappCl.client.GetGroupInfoFromLink(target)
+		if err != nil {
+			return types.EmptyJID, "", fmt.Errorf("Invalid group invite link: %s (%v)", target, err)
+		}
+		joined, err := r.isJoined(info.JID)
+		if err != nil || joined {
+			return info.JID, "", err
+		}
+		return info.JID, target, nil
+	case strings.Contains(target, "@"):
+		jid, err := types.ParseJID(target)
+		if err != nil || jid.Server != types.GroupServer {
+			return types.EmptyJID, "", fmt.Errorf("Invalid group: %s", target)
+		}
+		joined, err := r.isJoined(jid)
+		if err != nil {
+			return types.EmptyJID, "", err
+		}
+		if !joined {
+			return types.EmptyJID, "", fmt.Errorf("Invalid group: the bot is not a member of %s", target)
+		}
+		return jid, "", nil
+	}
+	groups, err := r.joinedGroups()
+	if err != nil {
+		return types.EmptyJID, "", err
+	}
+	var matches []types.JID
+	for _, group := range groups {
+		if strings.EqualFold(strings.TrimSpace(group.Name), target) {
+			matches = append(matches, group.JID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return types.EmptyJID, "", fmt.Errorf("Invalid group: the bot is not a member of a group named %q", target)
+	case 1:
+		return matches[0], "", nil
+	}
+	return types.EmptyJID, "", fmt.Errorf("Ambiguous group: %d groups are named %q, use the group JID", len(matches), target)
+}
+
+// joinInviteLinks joins the groups of the invite links of an accepted
+// request, the bot was not a member of them yet
+func joinInviteLinks(req *SendMessageRequest) FieldErrors {
+	errs := FieldErrors{}
+	for _, recipient := range req.recipients {
+		if recipient.InviteLink == "" {
+			continue
+		}
+		if _, err := WhatsappCl.client.JoinGroupWithLink(recipient.InviteLink); err != nil {
+			for _, field := range recipient.Fields {
+				errs[field] = fmt.Sprintf("Failed to join the group of %s: %v", recipient.InviteLink, err)
+			}
+		}
+	}
+	return errs
+}
+
+// listGroups returns the groups the bot belongs to with their participants
+func listGroups(c *gin.Context) {
+	if !requireConnection(c) {
+		return
+	}
+	joined, err := WhatsappCl.client.GetJoinedGroups()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Failed to list the groups: %v", err))
+		return
+	}
+	groups := make([]Group, len(joined))
+	for i, info := range joined {
+		groups[i] = newGroup(info)
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Page sizes of the history endpoints
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// ChatMessage is a message received or sent by the bot
+type ChatMessage struct {
+	ID        uint   `gorm:"primaryKey" json:"-"`
+	MessageID string `gorm:"uniqueIndex:idx_chat_message" json:"id"`
+	Chat      string `gorm:"uniqueIndex:idx_chat_message;index" json:"chat"`
+	Sender    string `gorm:"index" json:"sender"`
+	PushName  string `json:"push_name,omitempty"`
+	FromMe    bool   `json:"from_me"`
+	Type      string `gorm:"index" json:"type"`
+	Text      string `json:"text,omitempty"`
+	MimeType  string `json:"mime_type,omitempty"`
+	FileName  string `json:"file_name,omitempty"`
+	FileSize  uint64 `json:"file_size,omitempty"`
+	// MediaID is the stored file of a received media, see GET /media/{id}
+	MediaID string `json:"media_id,omitempty"`
+	// JobID is set for the messages sent by a send job
+	JobID     string    `json:"job_id,omitempty"`
+	Timestamp time.Time `gorm:"index" json:"timestamp"`
+}
+
+// Chat is a conversation of the bot with its last activity
+type Chat struct {
+	JID           string    `gorm:"primaryKey;column:jid" json:"jid"`
+	Name          string    `json:"name,omitempty"`
+	IsGroup       bool      `json:"is_group"`
+	Messages      int       `json:"messages"`
+	LastMessageID string    `json:"last_message_id"`
+	LastMessageAt time.Time `gorm:"index" json:"last_message_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ChatPage is a page of GET /chats
+type ChatPage struct {
+	Chats      []Chat `json:"chats"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// MessagePage is a page of GET /chats/{jid}/messages, the latest messages first
+type MessagePage struct {
+	Messages   []ChatMessage `json:"messages"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// storeMessage adds a message to the history of its chat, a message already
+// stored is ignored
+func storeMessage(incoming IncomingMessage, fromMe bool, jobID string) {
+	if _botdb == nil {
+		return
+	}
+	message := ChatMessage{
+		MessageID: incoming.ID,
+		Chat:      incoming.Chat,
+		Sender:    incoming.Sender,
+		PushName:  incoming.PushName,
+		FromMe:    fromMe,
+		Type:      incoming.Type,
+		Text:      incoming.Text,
+		MimeType:  incoming.MimeType,
+		FileName:  incoming.FileName,
+		FileSize:  incoming.FileSize,
+		JobID:     jobID,
+		Timestamp: incoming.Timestamp,
+	}
+	err := _botdb.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&message)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		chat := Chat{JID: incoming.Chat, IsGroup: incoming.IsGroup}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&chat).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"messages":        gorm.Expr("messages + 1"),
+			"last_message_id": message.MessageID,
+			"last_message_at": message.Timestamp,
+		}
+		// the name of a direct chat is the push name of the contact
+		if !fromMe && !incoming.IsGroup && incoming.PushName != "" {
+			updates["name"] = incoming.PushName
+		}
+		return tx.Model(&chat).Updates(updates).Error
+	})
+	if err != nil {
+		fmt.Printf("History error: %v\n", err)
+	}
+}
+
+// recordMessageEvent stores a message event, received or sent from another
+// device of the account. Protocol messages (revokes, keys...) are not stored.
+func recordMessageEvent(v *events.Message) {
+	if edit := messageEdit(v.Message); edit != nil {
+		storeEdit(v.Info.Chat, edit)
+		return
+	}
+	if v.Message.GetProtocolMessage() != nil {
+		return
+	}
+	incoming := newIncomingMessage(v)
+	if incoming.Type == "other" {
+		return
+	}
+	storeMessage(incoming, v.Info.IsFromMe, "")
+}
+
+// recordSentMessage stores a message sent by the bot, an edit updates the
+// text of the message it edits
+func recordSentMessage(to types.JID, msg *waProto.Message, id string, timestamp time.Time, jobID string) {
+	if edit := messageEdit(msg); edit != nil {
+		storeEdit(to, edit)
+		return
+	}
+	if msg.GetProtocolMessage() != nil {
+		return
+	}
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: to, IsFromMe: true, IsGroup: to.Server == types.GroupServer},
+		ID:            id,
+		Timestamp:     timestamp,
+	}
+	if WhatsappCl.client != nil && WhatsappCl.client.Store.ID != nil {
+		info.Sender = WhatsappCl.client.Store.ID.ToNonAD()
+	}
+	storeMessage(newIncomingMessage(&events.Message{Info: info, Message: msg}), true, jobID)
+}
+
+// messageEdit returns the protocol message of an edit, nil for other messages
+func messageEdit(msg *waProto.Message) *waProto.ProtocolMessage {
+	protocol := msg.GetProtocolMessage()
+	if edited := msg.GetEditedMessage().GetMessage().GetProtocolMessage(); edited != nil {
+		protocol = edited
+	}
+	if protocol.GetType() != waProto.ProtocolMessage_MESSAGE_EDIT {
+		return nil
+	}
+	return protocol
+}
+
+// storeEdit replaces the text of a stored message with the one of its edit
+func storeEdit(chat types.JID, edit *waProto.ProtocolMessage) {
+	if _botdb == nil {
+		return
+	}
+	edited := newIncomingMessage(&events.Message{Message: edit.GetEditedMessage()})
+	err := _botdb.Model(&ChatMessage{}).Where("chat = ? AND message_id = ?", chat.String(), edit.GetKey().GetId()).
+		Update("text", edited.Text).Error
+	if err != nil {
+		fmt.Printf("History error: %v\n", err)
+	}
+}
+
+// chatJID parses the chat of a history request, a bare number is a user chat
+func chatJID(value string) (types.JID, error) {
+	if !strings.Contains(value, "@") {
+		value = strings.TrimPrefix(value, "+") + "@" + types.DefaultUserServer
+	}
+	jid, err := types.ParseJID(value)
+	if err != nil || jid.User == "" {
+		return types.EmptyJID, fmt.Errorf("Invalid chat: %s", value)
+	}
+	return jid.ToNonAD(), nil
+}
+
+// historyLimit parses the limit of a page
+func historyLimit(value string) (int, error) {
+	if value == "" {
+		return defaultHistoryLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("must be a positive number")
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	return limit, nil
+}
+
+// historySince parses the since filter, an RFC 3339 time
+func historySince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time, e.g. 2023-07-01T09:00:00Z")
+	}
+	return since, nil
+}
+
+// listChats returns the chats, the most recently active first. The cursor
+// is the offset of the next page.
+func listChats(c *gin.Context) {
+	errs := FieldErrors{}
+	limit, err := historyLimit(c.Query("limit"))
+	if err != nil {
+		errs["limit"] = err.Error()
+	}
+	since, err := historySince(c.Query("since"))
+	if err != nil {
+		errs["since"] = err.Error()
+	}
+	offset := 0
+	if cursor := c.Query("cursor"); cursor != "" {
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			errs["cursor"] = "invalid cursor"
+		}
+	}
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+	query := _botdb.Order("last_message_at desc, jid").Limit(limit + 1).Offset(offset)
+	if !since.IsZero() {
+		query = query.Where("last_message_at >= ?", since)
+	}
+	chats := []Chat{}
+	if err := query.Find(&chats).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	page := ChatPage{Chats: chats}
+	if len(chats) > limit {
+		page.Chats = chats[:limit]
+		page.NextCursor = strconv.Itoa(offset + limit)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// listChatMessages returns the messages of a chat, the latest first,
+// filtered by since, sender and type. The cursor is the last message of the
+// previous page.
+func listChatMessages(c *gin.Context) {
+	errs := FieldErrors{}
+	jid, err := chatJID(c.Param("jid"))
+	if err != nil {
+		errs["jid"] = err.Error()
+	}
+	limit, err := historyLimit(c.Query("limit"))
+	if err != nil {
+		errs["limit"] = err.Error()
+	}
+	since, err := historySince(c.Query("since"))
+	if err != nil {
+		errs["since"] = err.Error()
+	}
+	var before uint64
+	if cursor := c.Query("cursor"); cursor != "" {
+		if before, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			errs["cursor"] = "invalid cursor"
+		}
+	}
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+	var chat Chat
+	if err := _botdb.First(&chat, "jid = ?", jid.String()).Error; err != nil {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Chat not found")
+		return
+	}
+
+	query := _botdb.Where("chat = ?", chat.JID).Order("id desc").Limit(limit + 1)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+	if !since.IsZero() {
+		query = query.Where("timestamp >= ?", since)
+	}
+	if sender := c.Query("sender"); sender != "" {
+		senderJID, err := chatJID(sender)
+		if err != nil {
+			abortWithFields(c, FieldErrors{"sender": err.Error()})
+			return
+		}
+		query = query.Where("sender = ?", senderJID.String())
+	}
+	if kind := c.Query("type"); kind != "" {
+		query = query.Where("type = ?", kind)
+	}
+	messages := []ChatMessage{}
+	if err := query.Find(&messages).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	page := MessagePage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		page.NextCursor = strconv.FormatUint(uint64(page.Messages[limit-1].ID), 10)
+	}
+	c.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// IdempotencyKeyHeader makes a send request safe to retry
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on the responses replayed from a previous request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// defaultIdempotencyTTL is how long a response is replayed, see IDEMPOTENCY_TTL
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKey     = 255
+)
+
+// IdempotencyRecord is the response to a request made with an Idempotency-Key
+type IdempotencyRecord struct {
+	ID uint `gorm:"primaryKey"`
+	// Key is the hash of the API key ID, the route and the Idempotency-Key
+	Key string `gorm:"uniqueIndex"`
+	// RequestHash is the hash of the body, a key reused with another body is rejected
+	RequestHash string
+	Completed   bool
+	Status      int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+func hashParts(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// multipartFingerprint is the content of a multipart body without its random
+// boundary: the name of each field in order, its file name and the hash of its value
+func multipartFingerprint(body []byte, contentType string) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var fingerprint bytes.Buffer
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return fingerprint.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, part); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&fingerprint, "%q %q %x\n", part.FormName(), part.FileName(), hash.Sum(nil))
+	}
+}
+
+// idempotent replays the response of the first request made with the same
+// Idempotency-Key by the same API key, instead of sending the messages
+// again. Server errors and 429 are not kept, the request can then be retried.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		abortWithFields(c, FieldErrors{IdempotencyKeyHeader: "must be at most 255 characters"})
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithFields(c, FieldErrors{"body": "failed to read the body"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	// multipart bodies differ between retries by their random boundary
+	fingerprint := body
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		if fingerprint, err = multipartFingerprint(body, c.GetHeader("Content-Type")); err != nil {
+			abortWithFields(c, FieldErrors{"body": "invalid form data"})
+			return
+		}
+	}
+	now := time.Now()
+	// keyed by the API key the request authenticated with, not the raw header
+	keyID := strconv.FormatUint(uint64(requestKeyID(c)), 10)
+	record := IdempotencyRecord{
+		Key:         hashParts([]byte(keyID), []byte(c.Request.Method+" "+c.FullPath()), []byte(key)),
+		RequestHash: hashParts([]byte(c.ContentType()), fingerprint),
+		ExpiresAt:   now.Add(envDuration(IdempotencyTTLEnvVar, defaultIdempotencyTTL)),
+	}
+	_botdb.Where("expires_at < ?", now).Delete(&IdempotencyRecord{})
+	result := _botdb.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		var previous IdempotencyRecord
+		if err := _botdb.Where("key = ?", record.Key).First(&previous).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			abortWithError(c, http.StatusConflict, CodeConflict, "A request with this Idempotency-Key is in progress")
+			return
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+		switch {
+		case previous.RequestHash != record.RequestHash:
+			abortWithError(c, http.StatusUnprocessableEntity, CodeIdempotencyMismatch, "The Idempotency-Key was already used with another request body")
+		case !previous.Completed:
+			abortWithError(c, http.StatusConflict, CodeConflict, "A request with this Idempotency-Key is in progress")
+		default:
+			c.Header(IdempotentReplayedHeader, "true")
+			c.Data(previous.Status, previous.ContentType, previous.Body)
+			c.Abort()
+		}
+		return
+	}
+
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+
+	if writer.Status() >= http.StatusInternalServerError || writer.Status() == http.StatusTooManyRequests {
+		_botdb.Delete(&record)
+		return
+	}
+	_botdb.Model(&record).Updates(map[string]interface{}{
+		"completed":    true,
+		"status":       writer.Status(),
+		"content_type": writer.Header().Get("Content-Type"),
+		"body":         writer.body.Bytes(),
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Statuses of a send job and of each of its recipients
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+
+	RecipientPending  = "pending"
+	RecipientSent     = "sent"
+	RecipientFailed   = "failed"
+	RecipientCanceled = "canceled"
+	RecipientSkipped  = "skipped"
+)
+
+const (
+	// jobPollInterval is how often the worker looks for queued jobs when it was not woken up
+	jobPollInterval = 5 * time.Second
+	// defaultJobWait and maxJobWait bound how long ?wait holds a send request for its job
+	defaultJobWait = 30 * time.Second
+	maxJobWait     = 60 * time.Second
+)
+
+// SendJob is a /send-message request processed in the background
+type SendJob struct {
+	ID          string         `gorm:"primaryKey" json:"id"`
+	Status      string         `gorm:"index" json:"status"`
+	Message     string         `json:"message"`
+	Attachments []Attachment   `gorm:"foreignKey:OwnerID" json:"attachments,omitempty"`
+	Location    *LocationInput `gorm:"serializer:json" json:"location,omitempty"`
+	Contacts    []ContactInput `gorm:"serializer:json" json:"contacts,omitempty"`
+	LinkPreview bool           `json:"link_preview,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	ErrorCode   string         `json:"error_code,omitempty"`
+	CallbackURL string         `json:"callback_url,omitempty"`
+	// Template and TemplateVersion are set for jobs sent by /send-template
+	Template        string         `json:"template,omitempty"`
+	TemplateVersion int            `json:"template_version,omitempty"`
+	ScheduleID      string         `json:"schedule_id,omitempty"`
+	KeyID           uint           `json:"-"`
+	Total           int            `json:"total"`
+	Sent            int            `json:"sent"`
+	Failed          int            `json:"failed"`
+	Delivered       int            `json:"delivered"`
+	Read            int            `json:"read"`
+	Recipients      []JobRecipient `gorm:"foreignKey:JobID" json:"recipients"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	FinishedAt      *time.Time     `json:"finished_at,omitempty"`
+}
+
+// JobRecipient is the delivery state of one number of a job
+type JobRecipient struct {
+	ID          uint       `gorm:"primaryKey" json:"-"`
+	JobID       string     `gorm:"index" json:"-"`
+	Number      string     `json:"number"`
+	JID         string     `json:"jid"`
+	Message     string     `json:"message,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	ErrorCode   string     `json:"error_code,omitempty"`
+	MessageID   string     `json:"message_id,omitempty"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+}
+
+// content returns what the job sends to each recipient
+func (job *SendJob) content() MessageContent {
+	return MessageContent{
+		Message:     job.Message,
+		Attachments: job.Attachments,
+		Location:    job.Location,
+		Contacts:    job.Contacts,
+		LinkPreview: job.LinkPreview,
+	}
+}
+
+// refundUnsent gives back to the quotas of the key of the job the messages
+// of the recipients that were skipped, failed or canceled
+func (job *SendJob) refundUnsent() {
+	if job.KeyID == 0 {
+		return
+	}
+	var unsent int64
+	_botdb.Model(&JobRecipient{}).Where("job_id = ? AND status IN ?", job.ID, []string{RecipientSkipped, RecipientFailed, RecipientCanceled}).Count(&unsent)
+	if unsent > 0 {
+		refundQuota(&APIKey{ID: job.KeyID}, int(unsent)*partCount(job.content()))
+	}
+}
+
+// finished reports whether the job is over, successfully or not
+func (job *SendJob) finished() bool {
+	return job.Status == JobDone || job.Status == JobFailed || job.Status == JobCanceled
+}
+
+// httpStatus is 207 when some recipients of the job failed, the body then
+// holds the result of each recipient
+func (job *SendJob) httpStatus() int {
+	if job.Status == JobFailed {
+		return http.StatusMultiStatus
+	}
+	for _, recipient := range job.Recipients {
+		if recipient.Status == RecipientFailed {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusOK
+}
+
+// runKey sets apart the runs of a recurring schedule, which send the same
+// content on purpose and must not be dropped as duplicates
+func (job *SendJob) runKey() string {
+	if job.ScheduleID == "" {
+		return ""
+	}
+	return job.ID
+}
+
+// jobWake is signaled when a job is queued so the worker does not wait for the next poll
+var jobWake = make(chan struct{}, 1)
+
+// enqueueSendJob persists the request as a queued job and wakes the worker up
+func enqueueSendJob(req *SendMessageRequest) (*SendJob, error) {
+	job := &SendJob{
+		ID:          uuid.NewString(),
+		Status:      JobQueued,
+		Message:     req.Message,
+		Attachments: copyAttachments(req.attachments),
+		Location:    req.Location,
+		Contacts:    req.Contacts,
+		LinkPreview: req.LinkPreview,
+		CallbackURL: req.CallbackURL,
+		Total:       len(req.recipients),
+	}
+	job.ScheduleID = req.scheduleID
+	job.KeyID = req.keyID
+	if req.template != nil {
+		job.Template = req.template.Name
+		job.TemplateVersion = req.template.Version
+	}
+	for _, recipient := range req.recipients {
+		job.Recipients = append(job.Recipients, JobRecipient{
+			Number: recipient.Number,
+			JID:    recipient.JID.String(),
+			// rendered from a template, empty when the job message is sent as is
+			Message: recipient.Message,
+			Status:  RecipientPending,
+		})
+	}
+	if err := _botdb.Create(job).Error; err != nil {
+		return nil, err
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// getSendJob loads a job and its recipients
+func getSendJob(id string) (*SendJob, error) {
+	var job SendJob
+	if err := _botdb.Preload("Recipients").Preload("Attachments", orderedAttachments).First(&job, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// waitSendJob waits for a job to finish and returns its last state, which
+// may still be unfinished when the timeout is reached
+func waitSendJob(id string, timeout time.Duration) (*SendJob, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		job, err := getSendJob(id)
+		if err != nil || job.finished() || time.Now().After(deadline) {
+			return job, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// parseJobWait parses the ?wait parameter of a send request, "true" waits
+// for defaultJobWait, a duration ("10s") waits for up to maxJobWait
+func parseJobWait(value string) (time.Duration, error) {
+	switch strings.ToLower(value) {
+	case "", "false", "0":
+		return 0, nil
+	case "true", "1":
+		return defaultJobWait, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait <= 0 {
+		return 0, fmt.Errorf("Invalid wait: %s", value)
+	}
+	if wait > maxJobWait {
+		wait = maxJobWait
+	}
+	return wait, nil
+}
+
+// jobCanceled reports whether the job was canceled since it started
+func jobCanceled(id string) bool {
+	var job SendJob
+	if err := _botdb.Select("status").First(&job, "id = ?", id).Error; err != nil {
+		return false
+	}
+	return job.Status == JobCanceled
+}
+
+// cancelSendJob cancels a queued or running job, its pending recipients are not sent
+func cancelSendJob(id string) (*SendJob, error) {
+	job, err := getSendJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != JobQueued && job.Status != JobRunning {
+		return job, fmt.Errorf("job is already %s", job.Status)
+	}
+	now := time.Now()
+	err = _botdb.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(job).Updates(map[string]interface{}{"status": JobCanceled, "finished_at": &now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&JobRecipient{}).Where("job_id = ? AND status = ?", id, RecipientPending).Update("status", RecipientCanceled).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	// a running job is refunded and releases its files when the worker finishes it
+	if job.Status == JobQueued {
+		job.refundUnsent()
+		releaseAttachments(id)
+	}
+	_outbox.CancelJob(id)
+	return getSendJob(id)
+}
+
+// finishSendJob stores the final status and counters of a job
+func finishSendJob(job *SendJob, status string, jobErr error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"sent":        job.Sent,
+		"failed":      job.Failed,
+		"finished_at": &now,
+	}
+	if jobErr != nil {
+		code := errorCode(jobErr)
+		updates["error"] = jobErr.Error()
+		updates["error_code"] = code
+		_botdb.Model(&JobRecipient{}).Where("job_id = ? AND status = ?", job.ID, RecipientPending).
+			Updates(map[string]interface{}{"status": RecipientFailed, "error": jobErr.Error(), "error_code": code})
+	}
+	// a job canceled while running keeps its canceled status
+	_botdb.Model(job).Where("status <> ?", JobCanceled).Update("status", status)
+	if err := _botdb.Model(job).Updates(updates).Error; err != nil {
+		fmt.Printf("Job %s error: %v\n", job.ID, err)
+	}
+	job.refundUnsent()
+	releaseAttachments(job.ID)
+}
+
+// startJobWorker processes queued jobs one at a time. Jobs left running by a
+// previous process are queued again, their sent recipients are not resent.
+func startJobWorker() {
+	_botdb.Model(&SendJob{}).Where("status = ?", JobRunning).Update("status", JobQueued)
+	go func() {
+		for {
+			var job SendJob
+			err := _botdb.Preload("Recipients").Preload("Attachments", orderedAttachments).Where("status = ?", JobQueued).Order("created_at").First(&job).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				select {
+				case <-jobWake:
+				case <-time.After(jobPollInterval):
+				}
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Job worker error: %v\n", err)
+				time.Sleep(jobPollInterval)
+				continue
+			}
+			_botdb.Model(&job).Update("status", JobRunning)
+			if err := sendThem(&job); err != nil {
+				finishSendJob(&job, JobFailed, err)
+			} else {
+				finishSendJob(&job, JobDone, nil)
+			}
+		}
+	}()
+}
+
+// Handler function returning the status of a job
+func getJob(c *gin.Context) {
+	job, err := getSendJob(c.Param("id"))
+	if err != nil || !ownsResource(c, job.KeyID) {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+	c.JSON(job.httpStatus(), job)
+}
+
+// Handler function canceling a job
+func cancelJob(c *gin.Context) {
+	if job, err := getSendJob(c.Param("id")); err != nil || !ownsResource(c, job.KeyID) {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+	job, err := cancelSendJob(c.Param("id"))
+	switch {
+	case job == nil:
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Job not found")
+	case err != nil:
+		abortWithError(c, http.StatusConflict, CodeConflict, err.Error())
+	default:
+		c.JSON(http.StatusOK, job)
+	}
+}
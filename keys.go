@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultKeyOverlap is how long a rotated key is still accepted along its replacement
+	defaultKeyOverlap = 24 * time.Hour
+	maxKeyOverlap     = 30 * 24 * time.Hour
+)
+
+// RotateKeyRequest is the body of /keys/rotate
+type RotateKeyRequest struct {
+	// Overlap is how long the current key is still accepted, e.g. "1h", 24h by default and 720h at most
+	Overlap string `json:"overlap,omitempty"`
+}
+
+// RotatedKey is the replacement of a rotated key, its token is only returned once
+type RotatedKey struct {
+	KeyID          uint      `json:"key_id"`
+	Key            string    `json:"key"`
+	Deadline       time.Time `json:"deadline"`
+	Scopes         []string  `json:"scopes"`
+	OldKeyID       uint      `json:"old_key_id"`
+	OldKeyRevokeAt time.Time `json:"old_key_revoked_at"`
+}
+
+// RevokedKey is the state of a revoked key
+type RevokedKey struct {
+	KeyID     uint      `json:"key_id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    string    `json:"reason"`
+}
+
+// parseKeyOverlap reads the overlap of a rotation
+func parseKeyOverlap(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultKeyOverlap, nil
+	}
+	overlap, err := time.ParseDuration(value)
+	if err != nil || overlap < 0 || overlap > maxKeyOverlap {
+		return 0, fmt.Errorf("must be a duration between 0s and %s", maxKeyOverlap)
+	}
+	return overlap, nil
+}
+
+// Handler function rotating the API key of the request
+func rotateKey(c *gin.Context) {
+	var req RotateKeyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithFields(c, FieldErrors{"body": fmt.Sprintf("invalid JSON: %v", err)})
+			return
+		}
+	}
+	overlap, err := parseKeyOverlap(req.Overlap)
+	if err != nil {
+		abortWithFields(c, FieldErrors{"overlap": err.Error()})
+		return
+	}
+	// both keys are valid during the overlap, only admins choose its length
+	if overlap != defaultKeyOverlap && !requireScope(c, ScopeAdmin) {
+		return
+	}
+	old := requestAPIKey(c)
+	replacement, signed, err := _keymanager.RotateAPIKey(old.ID, overlap)
+	if err != nil {
+		abortWithError(c, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, RotatedKey{
+		KeyID:          replacement.ID,
+		Key:            signed,
+		Deadline:       replacement.Deadline,
+		Scopes:         replacement.ScopeList(),
+		OldKeyID:       old.ID,
+		OldKeyRevokeAt: time.Now().Add(overlap),
+	})
+}
+
+// Handler function revoking an API key, a key can revoke itself and admin keys any key
+func revokeKey(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "API key not found")
+		return
+	}
+	if requestAPIKey(c).ID != uint(id) && !requireScope(c, ScopeAdmin) {
+		return
+	}
+	reason := c.Query("reason")
+	if reason == "" {
+		reason = "revoked through the API"
+	}
+	var key APIKey
+	if err := _keymanager.db.First(&key, id).Error; err != nil {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "API key not found")
+		return
+	}
+	if err := _keymanager.RevokeAPIKey(key.ID, reason); err != nil {
+		abortWithError(c, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	_keymanager.db.First(&key, id)
+	c.JSON(http.StatusOK, RevokedKey{KeyID: key.ID, RevokedAt: *key.RevokedAt, Reason: key.RevokedReason})
+}
@@ -17,7 +17,6 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
@@ -48,18 +47,55 @@ const (
 	gmail_password       = "GMAIL_PASSWORD"
 	gmail_email          = "GMAIL_EMAIL"
 	manager_email        = "MANAGER_EMAIL"
-	maxTokens            = 4000
+	StreamRepliesEnvVar  = "STREAM_REPLIES"
+	StreamIntervalEnvVar = "STREAM_EDIT_INTERVAL_MS"
+	ReadReceiptsEnvVar   = "READ_RECEIPTS"
+	QuoteRepliesEnvVar   = "QUOTE_REPLIES"
+	GPTToolsEnvVar       = "GPT_TOOLS"
+	ToolMaxStepsEnvVar   = "GPT_TOOLS_MAX_STEPS"
+	FetchAllowlistEnvVar = "GPT_TOOLS_FETCH_ALLOWLIST"
+	// outbound queue pacing
+	OutboxPerMinuteEnvVar  = "OUTBOX_PER_MINUTE"
+	OutboxPerHourEnvVar    = "OUTBOX_PER_HOUR"
+	OutboxJitterEnvVar     = "OUTBOX_JITTER"
+	OutboxQuietHoursEnvVar = "OUTBOX_QUIET_HOURS"
+	OutboxDedupeEnvVar     = "OUTBOX_DEDUPE_WINDOW"
+	// outgoing webhooks
+	WebhookMaxAttemptsEnvVar = "WEBHOOK_MAX_ATTEMPTS"
+	// recipient numbers
+	DefaultCountryCodeEnvVar = "DEFAULT_COUNTRY_CODE"
+	PhoneCacheTTLEnvVar      = "PHONE_CACHE_TTL"
+	// received media storage
+	MediaStorageEnvVar  = "MEDIA_STORAGE"
+	MediaDirEnvVar      = "MEDIA_DIR"
+	MediaMaxBytesEnvVar = "MEDIA_MAX_BYTES"
+	MediaKindsEnvVar    = "MEDIA_KINDS"
+	S3EndpointEnvVar    = "S3_ENDPOINT"
+	S3BucketEnvVar      = "S3_BUCKET"
+	S3AccessKeyEnvVar   = "S3_ACCESS_KEY"
+	S3SecretKeyEnvVar   = "S3_SECRET_KEY"
+	S3RegionEnvVar      = "S3_REGION"
+	S3UseSSLEnvVar      = "S3_USE_SSL"
+	// event stream
+	EventsRetentionEnvVar = "EVENTS_RETENTION"
+	// idempotent send requests
+	IdempotencyTTLEnvVar = "IDEMPOTENCY_TTL"
+	// per API key rate limit and quotas
+	RateLimitEnvVar    = "RATE_LIMIT"
+	DailyQuotaEnvVar   = "DAILY_QUOTA"
+	MonthlyQuotaEnvVar = "MONTHLY_QUOTA"
+	maxTokens          = 4000
 )
 
 var globaldocs map[string][]schema.Document = map[string][]schema.Document{}
 
 type HuggingFaceResponse struct {
 	GeneratedText string `json:"generated_text"`
-	conversation  struct {
-		generated_responses []string `json:"generated_responses"`
-		past_user_inputs    []string `json:"past_user_inputs"`
+	Conversation  struct {
+		GeneratedResponses []string `json:"generated_responses"`
+		PastUserInputs     []string `json:"past_user_inputs"`
 	} `json:"conversation"`
-	warnings []string `json:"warnings"`
+	Warnings []string `json:"warnings"`
 }
 
 func GetHuggingFaceResponse(prompt string) (string, error) {
@@ -390,7 +426,13 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 	// 	Format:           &waProto.TemplateMessage_FourRowTemplate_{},
 	// }
 	return func(evt interface{}) {
+		dispatchWebhooks(evt)
+		publishEvent(evt)
 		switch v := evt.(type) {
+		case *events.Connected:
+			onConnected(client)
+		case *events.Receipt:
+			onReceipt(v)
 		case *events.LoggedOut:
 			err := client.Connect()
 			if err != nil {
@@ -399,51 +441,61 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 		case *events.Message:
 			var messageBody = v.Message.GetConversation()
 			fmt.Println("Message event:", v.Message.GetConversation(), v.Info.Type)
-			client.MarkRead([]string{v.Info.ID}, time.Now(), v.Info.Chat, v.Info.Sender)
+			onMessageReceived(client, v)
+			recordMessageEvent(v)
+			go storeReceivedMedia(client, v)
 			switch {
+			case v.Message.GetReactionMessage() != nil:
+				recordReaction(v)
 			case v.IsDocumentWithCaption:
+				defer beginReply(client, v)()
 				DocumentWithCaption := v.Message.DocumentMessage
 				if bytes, _error := client.Download(DocumentWithCaption); _error == nil {
 					switch DocumentWithCaption.GetMimetype() {
 					case "text/csv":
 						if csvfile, csvfileerr := GetTextFormatFromCSV(bytes); csvfileerr == nil {
 							if res, err := analyzeCSVData(csvfile, gpt, DocumentWithCaption.GetCaption(), v.Info.Sender.String()); err == nil {
-								client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+								reply(client, v, &waProto.Message{
 									Conversation: proto.String(res),
 								})
 							} else {
-								client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+								reply(client, v, &waProto.Message{
 									Conversation: proto.String(fmt.Sprintf("__%s__", err.Error())),
 								})
 							}
 						} else {
-							client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+							reply(client, v, &waProto.Message{
 								Conversation: proto.String(fmt.Sprintf("__%s__", csvfileerr.Error())),
 							})
 						}
 					default:
-						client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+						reply(client, v, &waProto.Message{
 							Conversation: proto.String("File format is not implimented yet!"),
 						})
 					}
 				}
 			case v.Info.Type == "media" && !v.IsDocumentWithCaption:
-				client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+				defer beginReply(client, v)()
+				reply(client, v, &waProto.Message{
 					Conversation: proto.String("File format is not implimented yet!"),
 				})
 			case strings.ToLower(messageBody) == "ping":
-				client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+				defer beginReply(client, v)()
+				reply(client, v, &waProto.Message{
 					Conversation: proto.String("pong"),
 				})
 			case strings.HasPrefix(strings.ToLower(messageBody), "/askdoc"):
+				defer beginReply(client, v)()
 				args := strings.Fields(messageBody)[1:]
 				the_rest := strings.Join(args, " ")
 				if res, err := askdocument(gpt, the_rest, v.Info.Sender.String()); err == nil {
-					client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+					if resp, err := reply(client, v, &waProto.Message{
 						Conversation: proto.String(res),
-					})
+					}); err == nil {
+						recordAnswer(resp.ID, v, the_rest, res)
+					}
 				} else {
-					client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+					reply(client, v, &waProto.Message{
 						Conversation: proto.String(fmt.Sprintf("__%s__", err.Error())),
 					})
 				}
@@ -486,11 +538,38 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 						Messages: _allmessages,
 					}
 				}
+			case strings.HasPrefix(strings.ToLower(messageBody), "/quote"):
+				defer beginReply(client, v)()
+				args := strings.Fields(strings.ToLower(messageBody))[1:]
+				switch {
+				case len(args) == 0:
+					state := "off"
+					if quoteRepliesIn(v.Info.Chat.String()) {
+						state = "on"
+					}
+					replyText(client, v, fmt.Sprintf("quoted replies are %s, use /quote on|off", state))
+				case args[0] == "on" || args[0] == "off":
+					if err := setQuoteReplies(v.Info.Chat.String(), args[0] == "on"); err != nil {
+						replyText(client, v, fmt.Sprintf("__%s__", err.Error()))
+					} else {
+						replyText(client, v, fmt.Sprintf("quoted replies turned %s", args[0]))
+					}
+				default:
+					replyText(client, v, "usage: /quote on|off")
+				}
+			case strings.HasPrefix(strings.ToLower(messageBody), "/remind"):
+				defer beginReply(client, v)()
+				if schedule, err := createReminder(v.Info.Chat, strings.Fields(messageBody)[1:]); err != nil {
+					replyText(client, v, err.Error())
+				} else {
+					replyText(client, v, fmt.Sprintf("I will remind you on %s", schedule.NextRunAt.Format("Mon Jan 2 at 15:04")))
+				}
 			case strings.HasPrefix(strings.ToLower(messageBody), "/set_group_name"):
 				args := strings.Fields(messageBody)[1:]
 				name := strings.Join(args, " ")
 				if irr := client.SetGroupName(v.Info.Chat, name); irr != nil {
-					_, err := client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+					defer beginReply(client, v)()
+					_, err := reply(client, v, &waProto.Message{
 						Conversation: proto.String(irr.Error()),
 					})
 					if err != nil {
@@ -498,6 +577,7 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 					}
 				}
 			case strings.HasPrefix(strings.ToLower(messageBody), "/image"):
+				defer beginReply(client, v)()
 				args := strings.Fields(messageBody)[1:]
 				query := strings.Join(args, " ")
 				fmt.Printf("query: %s", query)
@@ -516,71 +596,35 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 				// 	  DirectPath:    &up.DirectPath,
 				// 	}
 				//   }
-				config := &services.GoogleConfig{
-					Query: query,
-				}
-				gs := &services.GoogleScraper{Config: config}
-				items, _, _err := gs.Scrape()
-				if _err != nil {
-					fmt.Printf("ImageMessage error: %v\n", _err)
-					client.SendPresence(types.PresenceAvailable)
-					_, err := client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
-						Conversation: proto.String("images not found!"),
-					})
-					if err != nil {
-						fmt.Printf("ImageMessage error: %v\n", err)
+				if sent, err := sendImageResults(client, v, query, 4); err != nil {
+					fmt.Printf("ImageMessage error: %v\n", err)
+					if sent == 0 {
+						replyText(client, v, "images not found!")
 					}
 				}
-				var convertedItems = make([]services.GoogleResult, 4)
-				for i, item := range items {
-					if i <= 3 {
-						data, ok := ConvertToFlickrResult(item)
-						if ok {
-							convertedItems[i] = data
-						}
-					} else {
-						break
-					}
-				}
-				fmt.Print(convertedItems)
-				if len(convertedItems) > 0 {
-					for i := 0; i < len(convertedItems); i++ {
-						if convertedItems[i].URL != "" {
-							bytedata, mimeType, __err := GetImageBytes(convertedItems[i].URL)
-							if __err != nil {
-								fmt.Printf("ImageMessage error: %v\n", __err)
-								return
-							} else {
-								if up, err := client.Upload(context.Background(), bytedata, whatsmeow.MediaImage); err == nil {
-									var message = &waProto.ImageMessage{
-										Url:           &up.URL,
-										Mimetype:      proto.String(mimeType),
-										Caption:       proto.String(convertedItems[i].Title),
-										FileSha256:    up.FileSHA256,
-										FileEncSha256: up.FileEncSHA256,
-										FileLength:    &up.FileLength,
-										MediaKey:      up.MediaKey,
-										DirectPath:    &up.DirectPath,
-									}
-									_, err := client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
-										ImageMessage: message,
-									})
-									if err != nil {
-										fmt.Printf("ImageMessage error: %v\n", err)
-										return
-									}
-								} else {
-									fmt.Printf("Upload error: %v", err)
-								}
-							}
-						}
-					}
-
-				}
 			default:
 				if !v.Info.Sender.IsEmpty() {
 					fmt.Printf("new message: %s in %s\n", v.Info.Sender.String(), v.Info.Chat.String())
 					if !contains(block_peoples, v.Info.Sender.String()) && contains(allowed_groups, v.Info.Chat.String()) {
+						defer beginReply(client, v)()
+						if toolsEnabled() {
+							response, err := GenerateGPTToolResponse(messageBody, &ToolContext{Client: client, Event: v, GPT: gpt}, gpt)
+							if err != nil {
+								fmt.Printf("ChatCompletion error: %v\n", err)
+								replyText(client, v, fmt.Sprintf("__%s__", err.Error()))
+								return
+							}
+							if resp, err := replyText(client, v, response); err == nil {
+								recordAnswer(resp.ID, v, messageBody, response)
+							}
+							return
+						}
+						if streamingEnabled() {
+							if err := streamGPTReply(client, v, messageBody, gpt); err != nil {
+								fmt.Printf("ChatCompletionStream error: %v\n", err)
+							}
+							return
+						}
 						response, err := GenerateGPTResponse(messageBody, v.Info.Sender.String(), gpt)
 						// // response, err := GetHuggingFaceResponse(messageBody)
 						if err != nil {
@@ -589,12 +633,13 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 						}
 						if len(response) > 0 {
 							// Create a buttons message.
-							client.SendPresence(types.PresenceAvailable)
-							_, err := client.SendMessage(context.Background(), v.Info.Chat, &waProto.Message{
+							resp, err := reply(client, v, &waProto.Message{
 								Conversation: proto.String(response),
 							})
 							if err != nil {
 								fmt.Printf("ERROR Message: %v", err)
+							} else {
+								recordAnswer(resp.ID, v, messageBody, response)
 							}
 						}
 					}
@@ -604,17 +649,70 @@ func GetEventHandler(client *whatsmeow.Client, gpt *openai.Client) func(interfac
 	}
 }
 
-func GenerateGPTResponse(input string, user string, gpt *openai.Client) (string, error) {
-	var _allmessages []openai.ChatCompletionMessage
-	if _, ok := _req[user]; !ok {
+// chatHistory returns the stored conversation of a user, or a fresh one
+// holding only the default system prompt.
+func chatHistory(user string) []openai.ChatCompletionMessage {
+	if req, ok := _req[user]; ok && len(req.Messages) > 0 {
+		return req.Messages
+	}
+	return []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: "you are a helpful personal assistant",
+		},
+	}
+}
 
-		_allmessages = []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: "you are a helpful personal assistant",
-			},
+// sendImageResults searches images for query and replies with up to limit of
+// them, returning how many were sent.
+func sendImageResults(client *whatsmeow.Client, v *events.Message, query string, limit int) (int, error) {
+	config := &services.GoogleConfig{
+		Query: query,
+	}
+	gs := &services.GoogleScraper{Config: config}
+	items, _, err := gs.Scrape()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for i, item := range items {
+		if i >= limit {
+			break
+		}
+		result, ok := ConvertToFlickrResult(item)
+		if !ok || result.URL == "" {
+			continue
 		}
+		bytedata, mimeType, err := GetImageBytes(result.URL)
+		if err != nil {
+			return sent, err
+		}
+		up, err := client.Upload(context.Background(), bytedata, whatsmeow.MediaImage)
+		if err != nil {
+			return sent, fmt.Errorf("upload error: %v", err)
+		}
+		var message = &waProto.ImageMessage{
+			Url:           &up.URL,
+			Mimetype:      proto.String(mimeType),
+			Caption:       proto.String(result.Title),
+			FileSha256:    up.FileSHA256,
+			FileEncSha256: up.FileEncSHA256,
+			FileLength:    &up.FileLength,
+			MediaKey:      up.MediaKey,
+			DirectPath:    &up.DirectPath,
+		}
+		if _, err := reply(client, v, &waProto.Message{
+			ImageMessage: message,
+		}); err != nil {
+			return sent, err
+		}
+		sent++
 	}
+	return sent, nil
+}
+
+func GenerateGPTResponse(input string, user string, gpt *openai.Client) (string, error) {
+	_allmessages := chatHistory(user)
 	_allmessages = append(_allmessages, openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleUser,
 		Content: input,
@@ -630,6 +728,7 @@ func GenerateGPTResponse(input string, user string, gpt *openai.Client) (string,
 	if err != nil {
 		return "fails!!!", fmt.Errorf("chatCompletion error: %v", err)
 	}
+	recordUsage(UsageEntry{Action: UsageReply, Reference: chatReference(user), LLMTokens: resp.Usage.TotalTokens})
 	_allmessages = append(_allmessages, resp.Choices[0].Message)
 	_req[user] = openai.ChatCompletionRequest{
 		Model:    openai.GPT3Dot5Turbo,
@@ -655,6 +754,12 @@ func main() {
 		panic(err)
 	}
 
+	_botdb = init_botdb()
+	initMediaStore()
+	_outbox.Start()
+	startWebhookWorker()
+	startScheduler()
+	startEventPruner()
 	clientLog := waLog.Stdout("Client", "INFO", true)
 	WhatsappCl.client = whatsmeow.NewClient(deviceStore, clientLog)
 	// Initialize OpenAI GPT
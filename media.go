@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+)
+
+// Kinds of attachment, each one is sent as its own WhatsApp message type
+const (
+	AttachmentImage    = "image"
+	AttachmentVideo    = "video"
+	AttachmentAudio    = "audio"
+	AttachmentVoice    = "voice"
+	AttachmentSticker  = "sticker"
+	AttachmentDocument = "document"
+)
+
+const (
+	// maxAttachments is the maximum number of files sent with one message
+	maxAttachments = 10
+	// link previews read at most this much of the page and of its image
+	maxPreviewPage      = 512 << 10
+	maxPreviewThumbnail = 256 << 10
+)
+
+// attachmentKinds is the kind each allowed MIME type is sent as by default,
+// every allowed type can also be sent as a document
+var attachmentKinds = map[string]string{
+	"image/png":  AttachmentImage,
+	"image/jpeg": AttachmentImage,
+	"image/jpg":  AttachmentImage,
+	"image/gif":  AttachmentImage,
+	"image/webp": AttachmentSticker,
+	"video/mp4":  AttachmentVideo,
+	"video/3gpp": AttachmentVideo,
+	"audio/mpeg": AttachmentAudio,
+	"audio/mp4":  AttachmentAudio,
+	"audio/aac":  AttachmentAudio,
+	"audio/amr":  AttachmentAudio,
+	"audio/ogg":  AttachmentVoice,
+
+	"application/pdf": AttachmentDocument,
+	"text/csv":        AttachmentDocument,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": AttachmentDocument,
+	"application/msword": AttachmentDocument,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": AttachmentDocument,
+	"application/vnd.ms-excel": AttachmentDocument,
+	"application/zip":          AttachmentDocument,
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Attachment is a file sent with a job or a schedule, the owner is the ID of either
+type Attachment struct {
+	ID       uint   `gorm:"primaryKey" json:"-"`
+	OwnerID  string `gorm:"index" json:"-"`
+	Position int    `json:"-"`
+	Kind     string `json:"kind"`
+	Filename string `json:"filename,omitempty"`
+	MimeType string `json:"mime_type"`
+	Size     int    `json:"size"`
+	Data     []byte `json:"-"`
+
+	// field of the request the attachment comes from, for validation errors
+	field string
+}
+
+// orderedAttachments preloads the attachments in the order of the request
+func orderedAttachments(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+// copyAttachments returns the attachments detached from their owner, to be stored with another one
+func copyAttachments(attachments []Attachment) []Attachment {
+	copies := make([]Attachment, len(attachments))
+	for i, attachment := range attachments {
+		attachment.ID, attachment.OwnerID = 0, ""
+		copies[i] = attachment
+	}
+	return copies
+}
+
+// releaseAttachments clears the files of a finished job, their metadata is
+// kept for its status
+func releaseAttachments(ownerID string) {
+	_botdb.Model(&Attachment{}).Where("owner_id = ?", ownerID).Update("data", nil)
+}
+
+// attachmentKind checks the MIME type against the requested kind, the
+// default kind of the type is used when none is requested
+func attachmentKind(mimeType, requested string) (string, error) {
+	base, _, _ := mime.ParseMediaType(mimeType)
+	kind, ok := attachmentKinds[strings.ToLower(base)]
+	if !ok {
+		return "", fmt.Errorf("invalid file type %q. Allowed file types are: csv, pdf, docx, doc, xlsx, xls, zip, png, jpeg, jpg, gif, webp, mp4, 3gp, mp3, m4a, aac, amr, ogg", mimeType)
+	}
+	switch requested {
+	case "", kind, AttachmentDocument:
+		if requested != "" {
+			kind = requested
+		}
+		return kind, nil
+	case AttachmentAudio:
+		if kind == AttachmentVoice {
+			return requested, nil
+		}
+	case AttachmentVoice:
+		// voice notes have to be ogg/opus, caught by the default kind of audio/ogg
+	case AttachmentImage, AttachmentVideo, AttachmentSticker:
+	default:
+		return "", fmt.Errorf("unknown type %q, use image, video, audio, voice, sticker or document", requested)
+	}
+	return "", fmt.Errorf("a %s file cannot be sent as %s", mimeType, requested)
+}
+
+// LocationInput is a location pin sent with a message
+type LocationInput struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+// ContactInput is a contact card sent with a message, either a raw vCard or
+// a name and a phone number the vCard is built from
+type ContactInput struct {
+	Name  string `json:"name,omitempty"`
+	Phone string `json:"phone,omitempty"`
+	VCard string `json:"vcard,omitempty"`
+}
+
+// vcard returns the vCard of the contact
+func (c ContactInput) vcard() string {
+	if c.VCard != "" {
+		return c.VCard
+	}
+	number, _ := normalizePhone(c.Phone)
+	return fmt.Sprintf("BEGIN:VCARD\nVERSION:3.0\nFN:%s\nTEL;type=CELL;waid=%s:+%s\nEND:VCARD", c.Name, number, number)
+}
+
+// displayName returns the name shown on the contact card
+func (c ContactInput) displayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	for _, line := range strings.Split(c.VCard, "\n") {
+		if strings.HasPrefix(strings.ToUpper(line), "FN:") {
+			return strings.TrimSpace(line[3:])
+		}
+	}
+	return "Contact"
+}
+
+// MessageContent is what a job sends to each of its recipients
+type MessageContent struct {
+	Message     string
+	Attachments []Attachment
+	Location    *LocationInput
+	Contacts    []ContactInput
+	LinkPreview bool
+}
+
+// outgoingPart is one of the WhatsApp messages a job sends to each recipient
+type outgoingPart struct {
+	msg *waProto.Message
+	// key identifies the content of the part for deduplication
+	key []byte
+	// text is set on the part carrying the message text, which is replaced
+	// by the per-recipient messages of templates
+	text bool
+	// size is the size of the attached file, metered as media bytes
+	size int
+}
+
+// captionable reports whether the kind of attachment can carry the message as caption
+func captionable(kind string) bool {
+	return kind == AttachmentImage || kind == AttachmentVideo || kind == AttachmentDocument
+}
+
+// partCount is the number of messages buildOutgoingParts sends to each recipient
+func partCount(content MessageContent) int {
+	parts := len(content.Attachments)
+	textSent := content.Message == ""
+	for _, attachment := range content.Attachments {
+		textSent = textSent || captionable(attachment.Kind)
+	}
+	if !textSent {
+		parts++
+	}
+	if content.Location != nil {
+		parts++
+	}
+	if len(content.Contacts) > 0 {
+		parts++
+	}
+	return parts
+}
+
+// buildOutgoingParts uploads the attachments and builds the messages to send,
+// the text goes as caption of the first attachment able to carry one
+func buildOutgoingParts(content MessageContent) ([]outgoingPart, error) {
+	var parts []outgoingPart
+	textSent := content.Message == ""
+	for _, attachment := range content.Attachments {
+		caption := ""
+		if !textSent && captionable(attachment.Kind) {
+			caption = content.Message
+		}
+		msg, err := uploadAttachment(attachment, caption)
+		if err != nil {
+			return nil, fmt.Errorf("upload of %s failed: %v", attachment.Filename, err)
+		}
+		parts = append(parts, outgoingPart{msg: msg, key: attachment.Data, text: caption != "", size: len(attachment.Data)})
+		textSent = textSent || caption != ""
+	}
+	if !textSent {
+		// audio and stickers have no caption, the text goes before them
+		parts = append([]outgoingPart{{msg: textMessage(content.Message, content.LinkPreview), text: true}}, parts...)
+	}
+	if location := content.Location; location != nil {
+		key, _ := json.Marshal(location)
+		parts = append(parts, outgoingPart{key: key, msg: &waProto.Message{
+			LocationMessage: &waProto.LocationMessage{
+				DegreesLatitude:  proto.Float64(location.Latitude),
+				DegreesLongitude: proto.Float64(location.Longitude),
+				Name:             nonEmpty(location.Name),
+				Address:          nonEmpty(location.Address),
+			},
+		}})
+	}
+	if len(content.Contacts) > 0 {
+		key, _ := json.Marshal(content.Contacts)
+		cards := make([]*waProto.ContactMessage, len(content.Contacts))
+		for i, contact := range content.Contacts {
+			cards[i] = &waProto.ContactMessage{
+				DisplayName: proto.String(contact.displayName()),
+				Vcard:       proto.String(contact.vcard()),
+			}
+		}
+		msg := &waProto.Message{ContactMessage: cards[0]}
+		if len(cards) > 1 {
+			msg = &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{
+				DisplayName: proto.String(fmt.Sprintf("%d contacts", len(cards))),
+				Contacts:    cards,
+			}}
+		}
+		parts = append(parts, outgoingPart{msg: msg, key: key})
+	}
+	return parts, nil
+}
+
+func nonEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return proto.String(value)
+}
+
+// uploadAttachment uploads a file and builds the message of its kind
+func uploadAttachment(attachment Attachment, caption string) (*waProto.Message, error) {
+	mediaType := map[string]whatsmeow.MediaType{
+		AttachmentImage:    whatsmeow.MediaImage,
+		AttachmentSticker:  whatsmeow.MediaImage,
+		AttachmentVideo:    whatsmeow.MediaVideo,
+		AttachmentAudio:    whatsmeow.MediaAudio,
+		AttachmentVoice:    whatsmeow.MediaAudio,
+		AttachmentDocument: whatsmeow.MediaDocument,
+	}[attachment.Kind]
+	up, err := WhatsappCl.client.Upload(context.Background(), attachment.Data, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	switch attachment.Kind {
+	case AttachmentImage:
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Url:           &up.URL,
+			Mimetype:      proto.String(attachment.MimeType),
+			Caption:       nonEmpty(caption),
+			FileSha256:    up.FileSHA256,
+			FileEncSha256: up.FileEncSHA256,
+			FileLength:    &up.FileLength,
+			MediaKey:      up.MediaKey,
+			DirectPath:    &up.DirectPath,
+		}}, nil
+	case AttachmentSticker:
+		return &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			Url:           &up.URL,
+			Mimetype:      proto.String("image/webp"),
+			FileSha256:    up.FileSHA256,
+			FileEncSha256: up.FileEncSHA256,
+			FileLength:    &up.FileLength,
+			MediaKey:      up.MediaKey,
+			DirectPath:    &up.DirectPath,
+		}}, nil
+	case AttachmentVideo:
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Url:           &up.URL,
+			Mimetype:      proto.String(attachment.MimeType),
+			Caption:       nonEmpty(caption),
+			FileSha256:    up.FileSHA256,
+			FileEncSha256: up.FileEncSHA256,
+			FileLength:    &up.FileLength,
+			MediaKey:      up.MediaKey,
+			DirectPath:    &up.DirectPath,
+		}}, nil
+	case AttachmentAudio, AttachmentVoice:
+		mimeType := attachment.MimeType
+		if attachment.Kind == AttachmentVoice {
+			// voice notes are only played inline as opus
+			mimeType = "audio/ogg; codecs=opus"
+		}
+		return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			Url:           &up.URL,
+			Mimetype:      proto.String(mimeType),
+			Ptt:           proto.Bool(attachment.Kind == AttachmentVoice),
+			FileSha256:    up.FileSHA256,
+			FileEncSha256: up.FileEncSHA256,
+			FileLength:    &up.FileLength,
+			MediaKey:      up.MediaKey,
+			DirectPath:    &up.DirectPath,
+		}}, nil
+	}
+	return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+		Url:           &up.URL,
+		Mimetype:      proto.String(attachment.MimeType),
+		Caption:       nonEmpty(caption),
+		FileSha256:    up.FileSHA256,
+		FileName:      proto.String(attachment.Filename),
+		FileEncSha256: up.FileEncSHA256,
+		FileLength:    &up.FileLength,
+		MediaKey:      up.MediaKey,
+		DirectPath:    &up.DirectPath,
+	}}, nil
+}
+
+// textMessage builds a text message, with the preview of its first link when asked
+func textMessage(text string, preview bool) *waProto.Message {
+	if preview {
+		if extended := linkPreview(text); extended != nil {
+			return &waProto.Message{ExtendedTextMessage: extended}
+		}
+	}
+	return &waProto.Message{Conversation: proto.String(text)}
+}
+
+// linkPreview fetches the first link of text and builds a message showing
+// its title, description and image. It returns nil when the text has no link
+// or the page cannot be read, the text is then sent without preview.
+func linkPreview(text string) *waProto.ExtendedTextMessage {
+	link := urlPattern.FindString(text)
+	if link == "" {
+		return nil
+	}
+	// the page and its thumbnail are fetched from public addresses only
+	client := publicHTTPClient(10 * time.Second)
+	resp, err := client.Get(link)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(resp.Body, maxPreviewPage))
+	if err != nil {
+		return nil
+	}
+	meta := func(property string) string {
+		value, _ := doc.Find(fmt.Sprintf(`meta[property="%s"], meta[name="%s"]`, property, property)).First().Attr("content")
+		return strings.TrimSpace(value)
+	}
+	title := meta("og:title")
+	if title == "" {
+		title = strings.TrimSpace(doc.Find("title").First().Text())
+	}
+	description := meta("og:description")
+	if description == "" {
+		description = meta("description")
+	}
+	if title == "" && description == "" {
+		return nil
+	}
+	extended := &waProto.ExtendedTextMessage{
+		Text:         proto.String(text),
+		MatchedText:  proto.String(link),
+		CanonicalUrl: proto.String(link),
+		Title:        nonEmpty(title),
+		Description:  nonEmpty(description),
+	}
+	if image := meta("og:image"); image != "" {
+		if base, err := url.Parse(link); err == nil {
+			if imageURL, err := base.Parse(image); err == nil {
+				extended.JpegThumbnail = previewThumbnail(client, imageURL.String())
+			}
+		}
+	}
+	return extended
+}
+
+// previewThumbnail downloads the image of a link preview, WhatsApp only shows JPEG thumbnails
+func previewThumbnail(client *http.Client, imageURL string) []byte {
+	resp, err := client.Get(imageURL)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/jpeg") {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPreviewThumbnail+1))
+	if err != nil || len(data) > maxPreviewThumbnail {
+		return nil
+	}
+	return data
+}
+
+// withText returns a copy of msg with its text or caption replaced, the
+// attachment uploaded once is shared by the copies
+func withText(msg *waProto.Message, text string) *waProto.Message {
+	msg = proto.Clone(msg).(*waProto.Message)
+	switch {
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.Caption = proto.String(text)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.Caption = proto.String(text)
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.Caption = proto.String(text)
+	case msg.ExtendedTextMessage != nil && strings.Contains(text, msg.ExtendedTextMessage.GetMatchedText()):
+		msg.ExtendedTextMessage.Text = proto.String(text)
+	default:
+		// the preview does not match the link of the new text anymore
+		return &waProto.Message{Conversation: proto.String(text)}
+	}
+	return msg
+}
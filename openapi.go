@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiParam is a path or query parameter of an operation
+type apiParam struct {
+	Name        string
+	In          string
+	Description string
+}
+
+// apiOperation documents one route of the API. The spec served at
+// /openapi.json is built from these and from the request and response
+// structs, checkAPIRoutes makes sure they match the routes of the router.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	Params  []apiParam
+	// Request and Response are values of the JSON bodies, their schemas are
+	// built from their types. A nil Response is an object without schema.
+	Request   interface{}
+	Multipart bool
+	Status    int
+	Response  interface{}
+	// Others are the other successful statuses and their bodies
+	Others map[int]interface{}
+	Errors []int
+	// ContentType is set for responses that are not JSON, their body is a
+	// file or a stream
+	ContentType string
+	// Public operations do not need an API key
+	Public bool
+}
+
+// undocumentedRoutes are served by the API but are not part of its spec
+var undocumentedRoutes = map[string]bool{
+	"GET /":             true,
+	"GET /docs":         true,
+	"GET /openapi.json": true,
+}
+
+var sendParams = []apiParam{
+	{Name: "wait", In: "query", Description: `"true" or a duration ("10s", 60s at most) to wait for the job and return its result`},
+	{Name: IdempotencyKeyHeader, In: "header", Description: "A unique key of the request, a retry with the same key returns the first response instead of sending again"},
+}
+
+// waitResponses are the results of a send that waited for its job
+var waitResponses = map[int]interface{}{http.StatusOK: SendJob{}, http.StatusMultiStatus: SendJob{}}
+
+var apiOperations = []apiOperation{
+	{Method: http.MethodPost, Path: "/send-message", Tag: "Messages", Summary: "Send a message to numbers and groups",
+		Params: sendParams, Request: SendMessageRequest{}, Multipart: true,
+		Status: http.StatusAccepted, Response: QueuedResponse{}, Others: waitResponses, Errors: []int{400, 401, 403, 409, 422, 429, 503}},
+	{Method: http.MethodPost, Path: "/send-template", Tag: "Messages", Summary: "Send a template rendered for each recipient",
+		Params: sendParams, Request: TemplateSendRequest{},
+		Status: http.StatusAccepted, Response: QueuedResponse{}, Others: waitResponses, Errors: []int{400, 401, 403, 404, 409, 422, 429, 503}},
+	{Method: http.MethodGet, Path: "/jobs/:id", Tag: "Jobs", Summary: "Get a job and the result of each recipient, 207 when some failed",
+		Status: http.StatusOK, Response: SendJob{}, Others: map[int]interface{}{http.StatusMultiStatus: SendJob{}}, Errors: []int{401, 403, 404, 429}},
+	{Method: http.MethodDelete, Path: "/jobs/:id", Tag: "Jobs", Summary: "Cancel a queued or running job",
+		Status: http.StatusOK, Response: SendJob{}, Errors: []int{401, 403, 404, 409, 429}},
+	{Method: http.MethodPost, Path: "/webhooks", Tag: "Webhooks", Summary: "Subscribe to events",
+		Request: WebhookRequest{}, Status: http.StatusCreated, Response: WebhookResponse{}, Errors: []int{400, 401, 403, 429}},
+	{Method: http.MethodGet, Path: "/webhooks", Tag: "Webhooks", Summary: "List the subscriptions",
+		Status: http.StatusOK, Response: []WebhookResponse{}, Errors: []int{401, 403, 429}},
+	{Method: http.MethodDelete, Path: "/webhooks/:id", Tag: "Webhooks", Summary: "Remove a subscription",
+		Status: http.StatusNoContent, Errors: []int{401, 403, 404, 429}},
+	{Method: http.MethodGet, Path: "/groups", Tag: "Groups", Summary: "List the groups of the bot",
+		Status: http.StatusOK, Response: struct {
+			Groups []Group `json:"groups"`
+		}{}, Errors: []int{401, 403, 429, 503}},
+	{Method: http.MethodPost, Path: "/templates", Tag: "Templates", Summary: "Save the next version of a template",
+		Request: TemplateRequest{}, Status: http.StatusCreated, Response: TemplateResponse{}, Errors: []int{400, 401, 403, 429}},
+	{Method: http.MethodGet, Path: "/templates", Tag: "Templates", Summary: "List the latest version of each template",
+		Status: http.StatusOK, Response: struct {
+			Templates []TemplateResponse `json:"templates"`
+		}{}, Errors: []int{401, 403, 429}},
+	{Method: http.MethodGet, Path: "/templates/:name", Tag: "Templates", Summary: "List the versions of a template",
+		Status: http.StatusOK, Response: struct {
+			Name     string             `json:"name"`
+			Versions []TemplateResponse `json:"versions"`
+		}{}, Errors: []int{401, 403, 404, 429}},
+	{Method: http.MethodGet, Path: "/schedules", Tag: "Schedules", Summary: "List the schedules",
+		Params: []apiParam{{Name: "status", In: "query", Description: "active, done, failed or canceled"}},
+		Status: http.StatusOK, Response: struct {
+			Schedules []ScheduleResponse `json:"schedules"`
+		}{}, Errors: []int{401, 403, 429}},
+	{Method: http.MethodGet, Path: "/schedules/:id", Tag: "Schedules", Summary: "Get a schedule",
+		Status: http.StatusOK, Response: ScheduleResponse{}, Errors: []int{401, 403, 404, 429}},
+	{Method: http.MethodDelete, Path: "/schedules/:id", Tag: "Schedules", Summary: "Cancel the next runs of a schedule",
+		Status: http.StatusOK, Response: CanceledSchedule{}, Errors: []int{401, 403, 404, 409, 429}},
+	{Method: http.MethodGet, Path: "/chats", Tag: "History", Summary: "List the chats, the most recently active first",
+		Params: []apiParam{
+			{Name: "since", In: "query", Description: "Only the chats active since this RFC 3339 time"},
+			{Name: "limit", In: "query", Description: "Page size, 50 by default and 200 at most"},
+			{Name: "cursor", In: "query", Description: "The next_cursor of the previous page"},
+		},
+		Status: http.StatusOK, Response: ChatPage{}, Errors: []int{400, 401, 403, 429}},
+	{Method: http.MethodGet, Path: "/chats/:jid/messages", Tag: "History", Summary: "List the messages of a chat, the latest first",
+		Params: []apiParam{
+			{Name: "since", In: "query", Description: "Only the messages since this RFC 3339 time"},
+			{Name: "sender", In: "query", Description: "Only the messages of this JID or number"},
+			{Name: "type", In: "query", Description: "Only the messages of this type: text, image, video, audio, document, sticker, location, contact or reaction"},
+			{Name: "limit", In: "query", Description: "Page size, 50 by default and 200 at most"},
+			{Name: "cursor", In: "query", Description: "The next_cursor of the previous page"},
+		},
+		Status: http.StatusOK, Response: MessagePage{}, Errors: []int{400, 401, 403, 404, 429}},
+	{Method: http.MethodGet, Path: "/media/:id", Tag: "History", Summary: "Download the file of a received media",
+		Status: http.StatusOK, ContentType: "application/octet-stream", Errors: []int{401, 403, 404, 429}},
+	{Method: http.MethodGet, Path: "/events", Tag: "Events", Summary: "Stream the events as Server-Sent Events, or over a WebSocket",
+		Params: []apiParam{
+			{Name: "events", In: "query", Description: "Comma separated event types, all of them by default"},
+			{Name: "chat", In: "query", Description: "Only the events of this chat JID or number"},
+			{Name: "last_event_id", In: "query", Description: "Resume after this event, as the Last-Event-ID header"},
+			{Name: "api_key", In: "query", Description: "The API key, for clients that cannot set the X-API-Key header"},
+		},
+		Status: http.StatusOK, ContentType: "text/event-stream", Errors: []int{400, 401, 403, 429}},
+	{Method: http.MethodGet, Path: "/usage", Tag: "Keys", Summary: "Get the rate limit and the quotas consumed by the API key",
+		Status: http.StatusOK, Response: UsageResponse{}, Errors: []int{401, 429}},
+	{Method: http.MethodGet, Path: "/usage/keys", Tag: "Keys", Summary: "Get the usage of every API key",
+		Status: http.StatusOK, Response: []UsageResponse{}, Errors: []int{401, 403, 429}},
+	{Method: http.MethodPost, Path: "/keys/rotate", Tag: "Keys", Summary: "Replace the API key, which is still accepted for the overlap",
+		Request: RotateKeyRequest{}, Status: http.StatusCreated, Response: RotatedKey{}, Errors: []int{400, 401, 409, 429}},
+	{Method: http.MethodDelete, Path: "/keys/:id", Tag: "Keys", Summary: "Revoke an API key, any key with the admin scope",
+		Params: []apiParam{{Name: "reason", In: "query", Description: "Why the key is revoked, shown when it is used"}},
+		Status: http.StatusOK, Response: RevokedKey{}, Errors: []int{401, 403, 404, 409, 429}},
+	{Method: http.MethodPost, Path: "/keygen", Tag: "Keys", Summary: "Generate an API key from a protobuf GenKeyRequest",
+		Status: http.StatusOK, Errors: []int{400, 401}, Public: true},
+}
+
+// openAPIPath converts a gin path ("/jobs/:id") to an OpenAPI one ("/jobs/{id}")
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// checkAPIRoutes reports the routes of the router missing from apiOperations
+// and the operations without a route. The admin panel is not part of the API.
+func checkAPIRoutes(routes gin.RoutesInfo) error {
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.Path] = true
+	}
+	var drift []string
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		if strings.HasPrefix(route.Path, "/admin") || undocumentedRoutes[key] {
+			continue
+		}
+		if !documented[key] {
+			drift = append(drift, "undocumented route "+key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		drift = append(drift, "documented route without handler "+key)
+	}
+	if len(drift) > 0 {
+		sort.Strings(drift)
+		return fmt.Errorf("the OpenAPI spec and the routes differ: %s", strings.Join(drift, ", "))
+	}
+	return nil
+}
+
+// schemaBuilder builds JSON schemas from Go types, named structs go to the
+// components of the spec and are referenced
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return gin.H{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return gin.H{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return gin.H{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			// registered before the fields so recursive types terminate
+			b.components[t.Name()] = gin.H{}
+			b.components[t.Name()] = b.object(t)
+		}
+		return gin.H{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return gin.H{}
+}
+
+// object is the schema of the JSON fields of a struct
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := gin.H{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+	}
+	return gin.H{"type": "object", "properties": properties}
+}
+
+// response is a successful response of an operation, 204 has no body
+func (b *schemaBuilder) response(status int, body interface{}, contentType string) gin.H {
+	response := gin.H{"description": http.StatusText(status)}
+	switch {
+	case status == http.StatusNoContent:
+	case contentType != "":
+		response["content"] = gin.H{contentType: gin.H{"schema": gin.H{"type": "string", "format": "binary"}}}
+	case body != nil:
+		response["content"] = gin.H{"application/json": gin.H{"schema": b.schema(reflect.TypeOf(body))}}
+	default:
+		response["content"] = gin.H{"application/json": gin.H{"schema": gin.H{"type": "object"}}}
+	}
+	return response
+}
+
+// sendMessageForm is the multipart variant of the /send-message body
+var sendMessageForm = gin.H{
+	"type": "object",
+	"properties": gin.H{
+		"numbers":      gin.H{"type": "array", "items": gin.H{"type": "string"}},
+		"groups":       gin.H{"type": "array", "items": gin.H{"type": "string"}},
+		"message":      gin.H{"type": "string"},
+		"callback_url": gin.H{"type": "string"},
+		"send_at":      gin.H{"type": "string", "format": "date-time"},
+		"repeat":       gin.H{"type": "string"},
+		"link_preview": gin.H{"type": "boolean"},
+		"file":         gin.H{"type": "array", "items": gin.H{"type": "string", "format": "binary"}},
+		"files":        gin.H{"type": "array", "items": gin.H{"type": "string", "format": "binary"}},
+	},
+}
+
+// buildOpenAPISpec returns the OpenAPI 3 document of the API
+func buildOpenAPISpec() gin.H {
+	builder := &schemaBuilder{components: map[string]interface{}{}}
+	builder.components["ErrorResponse"] = builder.object(reflect.TypeOf(ErrorResponse{}))
+	errorContent := gin.H{"application/json": gin.H{"schema": gin.H{"$ref": "#/components/schemas/ErrorResponse"}}}
+
+	paths := gin.H{}
+	for _, op := range apiOperations {
+		path := openAPIPath(op.Path)
+		var params []gin.H
+		for _, segment := range strings.Split(op.Path, "/") {
+			if strings.HasPrefix(segment, ":") {
+				params = append(params, gin.H{"name": segment[1:], "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+			}
+		}
+		for _, param := range op.Params {
+			params = append(params, gin.H{"name": param.Name, "in": param.In, "description": param.Description, "schema": gin.H{"type": "string"}})
+		}
+
+		responses := gin.H{fmt.Sprint(op.Status): builder.response(op.Status, op.Response, op.ContentType)}
+		for status, body := range op.Others {
+			responses[fmt.Sprint(status)] = builder.response(status, body, "")
+		}
+		for _, status := range op.Errors {
+			responses[fmt.Sprint(status)] = gin.H{"description": http.StatusText(status), "content": errorContent}
+		}
+
+		operation := gin.H{
+			"tags":        []string{op.Tag},
+			"summary":     op.Summary,
+			"operationId": strings.ToLower(op.Method) + strings.NewReplacer("/", "_", ":", "", "-", "_").Replace(op.Path),
+			"responses":   responses,
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			content := gin.H{"application/json": gin.H{"schema": builder.schema(reflect.TypeOf(op.Request))}}
+			if op.Multipart {
+				content["multipart/form-data"] = gin.H{"schema": sendMessageForm}
+			}
+			operation["requestBody"] = gin.H{"required": true, "content": content}
+		}
+		if op.Public {
+			operation["security"] = []gin.H{}
+		}
+		if _, ok := paths[path]; !ok {
+			paths[path] = gin.H{}
+		}
+		paths[path].(gin.H)[strings.ToLower(op.Method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":   "Unofficial WhatsApp Bot API",
+			"version": "1.0.0",
+		},
+		"security": []gin.H{{"ApiKey": []string{}}},
+		"paths":    paths,
+		"components": gin.H{
+			"schemas": builder.components,
+			"securitySchemes": gin.H{
+				"ApiKey": gin.H{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// Handler function returning the OpenAPI spec
+func openAPISpec(c *gin.Context) {
+	c.JSON(http.StatusOK, buildOpenAPISpec())
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Unofficial WhatsApp Bot API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>`
+
+// Handler function serving the interactive docs of the spec
+func docsHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
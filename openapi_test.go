@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestAPIRoutesDocumented fails when a route is missing from apiOperations
+// or an operation has no route
+func TestAPIRoutesDocumented(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := checkAPIRoutes(apiRouter().Routes()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+)
+
+// Statuses of an outbound message
+const (
+	OutboundQueued    = "queued"
+	OutboundSent      = "sent"
+	OutboundFailed    = "failed"
+	OutboundCanceled  = "canceled"
+	OutboundDuplicate = "duplicate"
+)
+
+// Priorities of outbound messages, bot replies go before bulk sends and are
+// not held back by quiet hours or jitter. Both count towards the rate limits,
+// the edits of a streamed reply do not.
+const (
+	PriorityBulk  = 0
+	PriorityReply = 10
+)
+
+// Defaults of the pacing settings
+const (
+	defaultOutboxPerMinute = 20
+	defaultOutboxPerHour   = 300
+	defaultOutboxJitter    = 700 * time.Millisecond
+	defaultDedupeWindow    = time.Hour
+	outboxPollInterval     = time.Second
+)
+
+var (
+	ErrOutboundCanceled  = errors.New("message canceled")
+	ErrOutboundDuplicate = errors.New("same message already sent to this recipient")
+)
+
+// OutboundMessage is a message waiting in, or gone through, the outbound queue
+type OutboundMessage struct {
+	ID        uint   `gorm:"primaryKey"`
+	Recipient string `gorm:"index"`
+	Payload   []byte
+	Priority  int
+	Edit      bool
+	Status    string `gorm:"index"`
+	DedupeKey string `gorm:"index"`
+	JobID     string `gorm:"index"`
+	Error     string
+	MessageID string
+	NotBefore time.Time
+	SentAt    *time.Time `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// OutboundOptions tune how a message goes through the queue
+type OutboundOptions struct {
+	Priority int
+	// Edit marks the edit of a message already sent, edits are not held back
+	// by the rate limits nor count towards them
+	Edit bool
+	// DedupeKey identifies the content sent to a recipient, a message whose
+	// key was already sent within the dedupe window is dropped
+	DedupeKey string
+	// JobID links the message to the send job it belongs to
+	JobID string
+}
+
+type outboundResult struct {
+	resp whatsmeow.SendResponse
+	err  error
+}
+
+// Outbox is the durable queue every outgoing message goes through. A single
+// worker drains it while enforcing the per-minute and per-hour limits, the
+// jitter between bulk messages and the quiet hours.
+type Outbox struct {
+	mu      sync.Mutex
+	waiters map[uint][]chan outboundResult
+	wake    chan struct{}
+}
+
+var _outbox = &Outbox{
+	waiters: map[uint][]chan outboundResult{},
+	wake:    make(chan struct{}, 1),
+}
+
+// dedupeKey identifies a message content sent to a recipient
+func dedupeKey(recipient string, parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s|%x", recipient, hash.Sum(nil))
+}
+
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+// quietHoursWait returns how long bulk sends must wait for the quiet hours
+// set in OUTBOX_QUIET_HOURS (e.g. "22:00-07:00", local time) to end
+func quietHoursWait(now time.Time) time.Duration {
+	bounds := strings.Split(os.Getenv(OutboxQuietHoursEnvVar), "-")
+	if len(bounds) != 2 {
+		return 0
+	}
+	start, err1 := time.Parse("15:04", strings.TrimSpace(bounds[0]))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(bounds[1]))
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	startAt := midnight.Add(time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute)
+	endAt := midnight.Add(time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute)
+	switch {
+	case !startAt.Before(endAt):
+		// the quiet hours span midnight
+		if now.Before(endAt) {
+			return endAt.Sub(now)
+		}
+		if !now.Before(startAt) {
+			return endAt.AddDate(0, 0, 1).Sub(now)
+		}
+	case !now.Before(startAt) && now.Before(endAt):
+		return endAt.Sub(now)
+	}
+	return 0
+}
+
+// rateLimitWait returns how long to wait before the next send fits in the
+// per-minute and per-hour limits
+func (o *Outbox) rateLimitWait(now time.Time) time.Duration {
+	var wait time.Duration
+	for _, limit := range []struct {
+		window time.Duration
+		max    int
+	}{
+		{time.Minute, envInt(OutboxPerMinuteEnvVar, defaultOutboxPerMinute)},
+		{time.Hour, envInt(OutboxPerHourEnvVar, defaultOutboxPerHour)},
+	} {
+		if limit.max == 0 {
+			continue
+		}
+		var sent []OutboundMessage
+		_botdb.Select("sent_at").Where("status = ? AND sent_at > ? AND edit = ?", OutboundSent, now.Add(-limit.window), false).
+			Order("sent_at desc").Limit(limit.max).Find(&sent)
+		if len(sent) < limit.max {
+			continue
+		}
+		// the oldest send of the window has to leave it
+		if w := sent[len(sent)-1].SentAt.Add(limit.window).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Enqueue persists a message to send to the recipient. A message with the
+// same dedupe key already waiting in the queue is returned instead of adding
+// a second one.
+func (o *Outbox) Enqueue(to types.JID, msg *waProto.Message, opts OutboundOptions) (*OutboundMessage, error) {
+	if opts.DedupeKey != "" {
+		var queued OutboundMessage
+		if err := _botdb.Where("dedupe_key = ? AND status = ?", opts.DedupeKey, OutboundQueued).First(&queued).Error; err == nil {
+			return &queued, nil
+		}
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	outbound := &OutboundMessage{
+		Recipient: to.String(),
+		Payload:   payload,
+		Priority:  opts.Priority,
+		Edit:      opts.Edit,
+		Status:    OutboundQueued,
+		DedupeKey: opts.DedupeKey,
+		JobID:     opts.JobID,
+		NotBefore: time.Now(),
+	}
+	if err := _botdb.Create(outbound).Error; err != nil {
+		return nil, err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return outbound, nil
+}
+
+// Send enqueues a message and waits for the worker to send it. When ctx is
+// done first the message is canceled if it is still queued.
+func (o *Outbox) Send(ctx context.Context, to types.JID, msg *waProto.Message, opts OutboundOptions) (whatsmeow.SendResponse, error) {
+	result := make(chan outboundResult, 1)
+	o.mu.Lock()
+	outbound, err := o.Enqueue(to, msg, opts)
+	if err != nil {
+		o.mu.Unlock()
+		return whatsmeow.SendResponse{}, err
+	}
+	o.waiters[outbound.ID] = append(o.waiters[outbound.ID], result)
+	o.mu.Unlock()
+
+	select {
+	case r := <-result:
+		return r.resp, r.err
+	case <-ctx.Done():
+		o.cancel(_botdb.Where("id = ?", outbound.ID))
+		return whatsmeow.SendResponse{}, ctx.Err()
+	}
+}
+
+// CancelJob cancels the queued messages of a send job
+func (o *Outbox) CancelJob(jobID string) {
+	o.cancel(_botdb.Where("job_id = ?", jobID))
+}
+
+func (o *Outbox) cancel(scope *gorm.DB) {
+	var canceled []OutboundMessage
+	scope.Where("status = ?", OutboundQueued).Find(&canceled)
+	for _, outbound := range canceled {
+		o.finish(&outbound, OutboundCanceled, whatsmeow.SendResponse{}, ErrOutboundCanceled)
+	}
+}
+
+// finish stores the outcome of a message and hands it to its waiters
+func (o *Outbox) finish(outbound *OutboundMessage, status string, resp whatsmeow.SendResponse, err error) {
+	updates := map[string]interface{}{"status": status}
+	if err != nil {
+		updates["error"] = err.Error()
+	}
+	if status == OutboundSent {
+		updates["message_id"] = resp.ID
+		updates["sent_at"] = time.Now()
+	}
+	_botdb.Model(&OutboundMessage{}).Where("id = ? AND status = ?", outbound.ID, OutboundQueued).Updates(updates)
+
+	o.mu.Lock()
+	waiters := o.waiters[outbound.ID]
+	delete(o.waiters, outbound.ID)
+	o.mu.Unlock()
+	for _, waiter := range waiters {
+		waiter <- outboundResult{resp: resp, err: err}
+	}
+}
+
+// next returns the queued message to send now, if any
+func (o *Outbox) next(now time.Time) (*OutboundMessage, error) {
+	var outbound OutboundMessage
+	err := _botdb.Where("status = ? AND not_before <= ?", OutboundQueued, now).
+		Order("priority desc, id").First(&outbound).Error
+	if err != nil {
+		return nil, err
+	}
+	return &outbound, nil
+}
+
+func (o *Outbox) sleep(d time.Duration) {
+	select {
+	case <-o.wake:
+	case <-time.After(d):
+	}
+}
+
+// Start runs the worker draining the queue
+func (o *Outbox) Start() {
+	go func() {
+		for {
+			now := time.Now()
+			outbound, err := o.next(now)
+			if err != nil {
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					fmt.Printf("Outbox error: %v\n", err)
+				}
+				o.sleep(outboxPollInterval)
+				continue
+			}
+			if WhatsappCl.client == nil || !WhatsappCl.client.IsConnected() {
+				o.sleep(outboxPollInterval)
+				continue
+			}
+			if outbound.Priority < PriorityReply {
+				if wait := quietHoursWait(now); wait > 0 {
+					_botdb.Model(outbound).Update("not_before", now.Add(wait))
+					continue
+				}
+			}
+			if wait := o.rateLimitWait(now); wait > 0 && !outbound.Edit {
+				// look again later, a reply may have been queued meanwhile
+				if wait > outboxPollInterval {
+					wait = outboxPollInterval
+				}
+				time.Sleep(wait)
+				continue
+			}
+			o.deliver(outbound)
+		}
+	}()
+}
+
+// deliver sends one message unless it is a duplicate of a recent one
+func (o *Outbox) deliver(outbound *OutboundMessage) {
+	if outbound.DedupeKey != "" {
+		var count int64
+		_botdb.Model(&OutboundMessage{}).Where("dedupe_key = ? AND status = ? AND sent_at > ?",
+			outbound.DedupeKey, OutboundSent, time.Now().Add(-envDuration(OutboxDedupeEnvVar, defaultDedupeWindow))).Count(&count)
+		if count > 0 {
+			o.finish(outbound, OutboundDuplicate, whatsmeow.SendResponse{}, ErrOutboundDuplicate)
+			return
+		}
+	}
+	if outbound.Priority < PriorityReply {
+		if jitter := envDuration(OutboxJitterEnvVar, defaultOutboxJitter); jitter > 0 {
+			time.Sleep(time.Duration(mathrand.Int63n(int64(jitter))))
+		}
+	}
+	var msg waProto.Message
+	if err := proto.Unmarshal(outbound.Payload, &msg); err != nil {
+		o.finish(outbound, OutboundFailed, whatsmeow.SendResponse{}, err)
+		return
+	}
+	to, err := types.ParseJID(outbound.Recipient)
+	if err != nil {
+		o.finish(outbound, OutboundFailed, whatsmeow.SendResponse{}, err)
+		return
+	}
+	resp, err := WhatsappCl.client.SendMessage(context.Background(), to, &msg)
+	if err != nil {
+		o.finish(outbound, OutboundFailed, resp, err)
+		return
+	}
+	recordSentMessage(to, &msg, resp.ID, resp.Timestamp, outbound.JobID)
+	o.finish(outbound, OutboundSent, resp, nil)
+}
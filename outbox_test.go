@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursWait(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2023, 7, 14, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name       string
+		quietHours string
+		now        time.Time
+		want       time.Duration
+	}{
+		{name: "unset", now: at(23, 0)},
+		{name: "invalid", quietHours: "night", now: at(23, 0)},
+		{name: "invalid time", quietHours: "25:00-07:00", now: at(23, 0)},
+		{name: "before midnight", quietHours: "22:00-07:00", now: at(23, 0), want: 8 * time.Hour},
+		{name: "after midnight", quietHours: "22:00-07:00", now: at(6, 30), want: 30 * time.Minute},
+		{name: "start", quietHours: "22:00-07:00", now: at(22, 0), want: 9 * time.Hour},
+		{name: "end", quietHours: "22:00-07:00", now: at(7, 0)},
+		{name: "outside", quietHours: "22:00-07:00", now: at(12, 0)},
+		{name: "spaces", quietHours: " 22:00 - 07:00 ", now: at(23, 0), want: 8 * time.Hour},
+		{name: "same day", quietHours: "12:00-14:00", now: at(13, 0), want: time.Hour},
+		{name: "same day before", quietHours: "12:00-14:00", now: at(11, 59)},
+		{name: "same day after", quietHours: "12:00-14:00", now: at(14, 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(OutboxQuietHoursEnvVar, test.quietHours)
+			if got := quietHoursWait(test.now); got != test.want {
+				t.Fatalf("quietHoursWait(%s) with %q = %s, want %s", test.now.Format("15:04"), test.quietHours, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// E.164 numbers have at most 15 digits, the shortest valid ones have 8 with the country code
+	minPhoneDigits = 8
+	maxPhoneDigits = 15
+	// defaultPhoneCacheTTL is how long an IsOnWhatsApp answer is trusted
+	defaultPhoneCacheTTL = 24 * time.Hour
+)
+
+// PhoneLookup caches the IsOnWhatsApp answer for a normalized number
+type PhoneLookup struct {
+	Number    string `gorm:"primaryKey"`
+	JID       string
+	IsIn      bool
+	CheckedAt time.Time
+}
+
+// normalizePhone turns a phone number written by a human ("+212 6-12 34 56 78",
+// "00212...", "0612...") into E.164 digits without the plus sign. Numbers in
+// national format (leading 0) get the DEFAULT_COUNTRY_CODE.
+func normalizePhone(raw string) (string, error) {
+	number := strings.TrimSpace(raw)
+	international := strings.HasPrefix(number, "+")
+	var digits strings.Builder
+	for i, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", fmt.Errorf("Invalid phone number: %s", raw)
+		}
+	}
+	number = digits.String()
+	switch {
+	case international:
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case strings.HasPrefix(number, "0"):
+		countryCode := strings.TrimPrefix(strings.TrimSpace(os.Getenv(DefaultCountryCodeEnvVar)), "+")
+		if countryCode == "" {
+			return "", fmt.Errorf("Invalid phone number: %s (national number without a default country code)", raw)
+		}
+		number = countryCode + number[1:]
+	}
+	if len(number) < minPhoneDigits || len(number) > maxPhoneDigits || strings.HasPrefix(number, "0") {
+		return "", fmt.Errorf("Invalid phone number: %s", raw)
+	}
+	return number, nil
+}
+
+// lookupPhones returns the WhatsApp JID of each normalized number, asking
+// WhatsApp only for the numbers missing from the cache. Numbers that are not
+// on WhatsApp are absent from the result.
+func lookupPhones(numbers []string) (map[string]types.JID, error) {
+	jids := map[string]types.JID{}
+	ttl := envDuration(PhoneCacheTTLEnvVar, defaultPhoneCacheTTL)
+	var cached []PhoneLookup
+	if err := _botdb.Where("number IN ? AND checked_at > ?", numbers, time.Now().Add(-ttl)).Find(&cached).Error; err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, lookup := range cached {
+		known[lookup.Number] = true
+		if jid, err := types.ParseJID(lookup.JID); lookup.IsIn && err == nil {
+			jids[lookup.Number] = jid
+		}
+	}
+	var queries []string
+	for _, number := range numbers {
+		if !known[number] {
+			queries = append(queries, "+"+number)
+		}
+	}
+	if len(queries) == 0 {
+		return jids, nil
+	}
+	responses, err := WhatsappCl.client.IsOnWhatsApp(queries)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, response := range responses {
+		lookup := PhoneLookup{
+			Number:    strings.TrimPrefix(response.Query, "+"),
+			JID:       response.JID.String(),
+			IsIn:      response.IsIn,
+			CheckedAt: now,
+		}
+		_botdb.Save(&lookup)
+		if response.IsIn {
+			jids[lookup.Number] = response.JID
+		}
+	}
+	return jids, nil
+}
+
+// resolveRecipients normalizes the numbers of the request and resolves the
+// JIDs of its numbers and groups. Every invalid recipient is reported under
+// its index, duplicates are dropped.
+func resolveRecipients(req *SendMessageRequest) FieldErrors {
+	errs := FieldErrors{}
+	var numbers []string
+	// indexes of the request numbers normalized to each number
+	indexes := map[string][]int{}
+	// group JIDs and links may be given among the numbers
+	var groups []string
+	groupFields := map[int]string{}
+	for i, raw := range req.Numbers {
+		if isGroupTarget(raw) {
+			groupFields[len(groups)] = fmt.Sprintf("numbers[%d]", i)
+			groups = append(groups, raw)
+			continue
+		}
+		number, err := normalizePhone(raw)
+		if err != nil {
+			errs[fmt.Sprintf("numbers[%d]", i)] = err.Error()
+			continue
+		}
+		if _, seen := indexes[number]; !seen {
+			numbers = append(numbers, number)
+		}
+		indexes[number] = append(indexes[number], i)
+	}
+	for i, group := range req.Groups {
+		groupFields[len(groups)] = fmt.Sprintf("groups[%d]", i)
+		groups = append(groups, group)
+	}
+
+	// the numbers and groups are all checked so that every error is reported at once
+	req.recipients = req.recipients[:0]
+	if len(numbers) > 0 {
+		jids, err := lookupPhones(numbers)
+		if err != nil {
+			errs["numbers"] = fmt.Sprintf("failed to check the numbers on WhatsApp: %v", err)
+			numbers = nil
+		}
+		for _, number := range numbers {
+			jid, ok := jids[number]
+			if !ok {
+				for _, i := range indexes[number] {
+					errs[fmt.Sprintf("numbers[%d]", i)] = fmt.Sprintf("Invalid phone number: %s is not on WhatsApp", req.Numbers[i])
+				}
+				continue
+			}
+			recipient := resolvedRecipient{Number: number, JID: jid}
+			for _, i := range indexes[number] {
+				recipient.Fields = append(recipient.Fields, fmt.Sprintf("numbers[%d]", i))
+			}
+			req.recipients = append(req.recipients, recipient)
+		}
+	}
+
+	resolver := &groupResolver{}
+	// position of each group in req.recipients
+	seen := map[types.JID]int{}
+	for i, group := range groups {
+		jid, inviteLink, err := resolver.resolve(group)
+		if err != nil {
+			errs[groupFields[i]] = err.Error()
+			continue
+		}
+		if at, ok := seen[jid]; ok {
+			req.recipients[at].Fields = append(req.recipients[at].Fields, groupFields[i])
+			continue
+		}
+		seen[jid] = len(req.recipients)
+		req.recipients = append(req.recipients, resolvedRecipient{Number: jid.String(), JID: jid, Fields: []string{groupFields[i]}, InviteLink: inviteLink})
+	}
+	return errs
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		raw         string
+		countryCode string
+		want        string
+		wantErr     bool
+	}{
+		{raw: "+212 6-12 34 56 78", want: "212612345678"},
+		{raw: "(212) 612.345.678", want: "212612345678"},
+		{raw: "00212612345678", want: "212612345678"},
+		{raw: "  +212612345678  ", want: "212612345678"},
+		{raw: "0612345678", countryCode: "212", want: "212612345678"},
+		{raw: "0612345678", countryCode: "+212", want: "212612345678"},
+		{raw: "0612345678", wantErr: true},
+		{raw: "+1234567", wantErr: true},
+		{raw: "+1234567890123456", wantErr: true},
+		{raw: "+0612345678", wantErr: true},
+		{raw: "212+612345678", wantErr: true},
+		{raw: "212abc345678", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.raw, func(t *testing.T) {
+			t.Setenv(DefaultCountryCodeEnvVar, test.countryCode)
+			got, err := normalizePhone(test.raw)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("normalizePhone(%q) = %q, want an error", test.raw, got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("normalizePhone(%q) = %q, %v, want %q", test.raw, got, err, test.want)
+			}
+		})
+	}
+}
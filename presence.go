@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// ReadReceiptPolicy decides when incoming messages are marked as read
+type ReadReceiptPolicy string
+
+const (
+	// ReadReceiptsAlways marks every incoming message as read
+	ReadReceiptsAlways ReadReceiptPolicy = "always"
+	// ReadReceiptsReply marks a message as read only when the bot answers it
+	ReadReceiptsReply ReadReceiptPolicy = "reply"
+	// ReadReceiptsNever never sends read receipts
+	ReadReceiptsNever ReadReceiptPolicy = "never"
+
+	// typingRefresh is how often the composing state is re-sent, WhatsApp drops it after ~25s
+	typingRefresh = 10 * time.Second
+)
+
+// readReceiptPolicy returns the configured policy, defaulting to ReadReceiptsAlways
+func readReceiptPolicy() ReadReceiptPolicy {
+	switch policy := ReadReceiptPolicy(strings.ToLower(os.Getenv(ReadReceiptsEnvVar))); policy {
+	case ReadReceiptsReply, ReadReceiptsNever:
+		return policy
+	default:
+		return ReadReceiptsAlways
+	}
+}
+
+// markRead sends a read receipt for the message
+func markRead(client *whatsmeow.Client, v *events.Message) {
+	if err := client.MarkRead([]string{v.Info.ID}, time.Now(), v.Info.Chat, v.Info.Sender); err != nil {
+		fmt.Printf("MarkRead error: %v\n", err)
+	}
+}
+
+// onMessageReceived applies the read-receipt policy to a freshly received message
+func onMessageReceived(client *whatsmeow.Client, v *events.Message) {
+	if readReceiptPolicy() == ReadReceiptsAlways {
+		markRead(client, v)
+	}
+}
+
+// beginReply is called when the bot is about to answer a message. It sends
+// the read receipt if the policy asks for it and shows "typing…" in the chat
+// until the returned function is called.
+//
+//	defer beginReply(client, v)()
+func beginReply(client *whatsmeow.Client, v *events.Message) func() {
+	if readReceiptPolicy() == ReadReceiptsReply {
+		markRead(client, v)
+	}
+	chat := v.Info.Chat
+	if err := client.SendChatPresence(chat, types.ChatPresenceComposing, types.ChatPresenceMediaText); err != nil {
+		fmt.Printf("ChatPresence error: %v\n", err)
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(typingRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				client.SendChatPresence(chat, types.ChatPresencePaused, types.ChatPresenceMediaText)
+				return
+			case <-ticker.C:
+				client.SendChatPresence(chat, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// onConnected marks the bot as available, chat presence updates are not
+// delivered while the account is unavailable.
+func onConnected(client *whatsmeow.Client) {
+	if err := client.SendPresence(types.PresenceAvailable); err != nil {
+		fmt.Printf("Presence error: %v\n", err)
+	}
+}
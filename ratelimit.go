@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Headers of the rate limit, set on every response of a limited key
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// limit resolves a limit of the key, 0 is unlimited
+func limit(value int, envVar string) int {
+	switch {
+	case value < 0:
+		return 0
+	case value == 0:
+		return envInt(envVar, 0)
+	}
+	return value
+}
+
+// RateLimitPerMinute is how many requests the key can make per minute
+func (k *APIKey) RateLimitPerMinute() int {
+	return limit(k.RateLimit, RateLimitEnvVar)
+}
+
+// DailyLimit is how many messages the key can send per day
+func (k *APIKey) DailyLimit() int {
+	return limit(k.DailyQuota, DailyQuotaEnvVar)
+}
+
+// MonthlyLimit is how many messages the key can send per month
+func (k *APIKey) MonthlyLimit() int {
+	return limit(k.MonthlyQuota, MonthlyQuotaEnvVar)
+}
+
+// tokenBucket holds up to a minute of requests and refills continuously
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps the buckets of the keys in memory, they start full
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[uint]*tokenBucket
+}
+
+var _rateLimiter = &rateLimiter{buckets: map[uint]*tokenBucket{}}
+
+// take takes a token from the bucket of the key. It returns the tokens left,
+// how long until the bucket is full again and, when it is empty, how long
+// until the next token.
+func (l *rateLimiter) take(keyID uint, perMinute int, now time.Time) (remaining int, reset, retry time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	capacity, rate := float64(perMinute), float64(perMinute)/time.Minute.Seconds()
+	bucket, ok := l.buckets[keyID]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[keyID] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		retry = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	} else {
+		bucket.tokens--
+	}
+	reset = time.Duration((capacity - bucket.tokens) / rate * float64(time.Second))
+	return int(bucket.tokens), reset, retry
+}
+
+// remaining returns the tokens left in the bucket of the key without taking one
+func (l *rateLimiter) remaining(keyID uint, perMinute int, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[keyID]
+	if !ok {
+		return perMinute
+	}
+	rate := float64(perMinute) / time.Minute.Seconds()
+	return int(math.Min(float64(perMinute), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate))
+}
+
+// retrySeconds rounds a wait up to whole seconds for Retry-After
+func retrySeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// rateLimit ends the request with 429 when the key made too many requests
+func rateLimit(c *gin.Context, key *APIKey) bool {
+	perMinute := key.RateLimitPerMinute()
+	if perMinute == 0 {
+		return true
+	}
+	remaining, reset, retry := _rateLimiter.take(key.Root(), perMinute, time.Now())
+	c.Header(RateLimitLimitHeader, strconv.Itoa(perMinute))
+	c.Header(RateLimitRemainingHeader, strconv.Itoa(remaining))
+	c.Header(RateLimitResetHeader, retrySeconds(reset))
+	if retry > 0 {
+		c.Header("Retry-After", retrySeconds(retry))
+		abortWithError(c, http.StatusTooManyRequests, CodeRateLimited, fmt.Sprintf("Rate limit of %d requests per minute exceeded", perMinute))
+		return false
+	}
+	return true
+}
+
+// QuotaCounter counts the messages sent by a key in a day ("2006-01-02") or
+// a month ("2006-01"), in UTC
+type QuotaCounter struct {
+	KeyID     uint   `gorm:"primaryKey;autoIncrement:false"`
+	Period    string `gorm:"primaryKey"`
+	Messages  int
+	UpdatedAt time.Time
+}
+
+// quotaPeriod is the day or the month a quota applies to
+type quotaPeriod struct {
+	name     string
+	period   string
+	limit    int
+	resetsAt time.Time
+}
+
+func quotaPeriods(key *APIKey, now time.Time) []quotaPeriod {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []quotaPeriod{
+		{name: "daily", period: day.Format("2006-01-02"), limit: key.DailyLimit(), resetsAt: day.AddDate(0, 0, 1)},
+		{name: "monthly", period: month.Format("2006-01"), limit: key.MonthlyLimit(), resetsAt: month.AddDate(0, 1, 0)},
+	}
+}
+
+func quotaUsed(keyID uint, period string) int {
+	var counter QuotaCounter
+	_botdb.Where("key_id = ? AND period = ?", keyID, period).Limit(1).Find(&counter)
+	return counter.Messages
+}
+
+func quotaLeft(limit, used int) int {
+	if used > limit {
+		return 0
+	}
+	return limit - used
+}
+
+// quotaMu makes checking and counting the messages of a request atomic
+var quotaMu sync.Mutex
+
+// quotaExceeded is returned by takeQuota when the messages do not fit in a quota
+type quotaExceeded struct {
+	quota quotaPeriod
+	used  int
+	// retry is how long until the quota resets
+	retry time.Duration
+}
+
+func (e *quotaExceeded) Error() string {
+	return fmt.Sprintf("The %s quota of %d messages would be exceeded, %d left", e.quota.name, e.quota.limit, quotaLeft(e.quota.limit, e.used))
+}
+
+// takeQuota counts messages against the daily and monthly quotas of a key,
+// nothing is counted when a quota would be exceeded
+func takeQuota(key *APIKey, messages int) error {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	now := time.Now()
+	periods := quotaPeriods(key, now)
+	for _, quota := range periods {
+		if quota.limit == 0 {
+			continue
+		}
+		if used := quotaUsed(key.Root(), quota.period); used+messages > quota.limit {
+			return &quotaExceeded{quota: quota, used: used, retry: quota.resetsAt.Sub(now)}
+		}
+	}
+	// counted even without quota, for the usage endpoint
+	for _, quota := range periods {
+		err := _botdb.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key_id"}, {Name: "period"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"messages": gorm.Expr("messages + ?", messages), "updated_at": now}),
+		}).Create(&QuotaCounter{KeyID: key.Root(), Period: quota.period, Messages: messages}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refundQuota gives back the messages of a send that failed after takeQuota
+func refundQuota(key *APIKey, messages int) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	for _, quota := range quotaPeriods(key, time.Now()) {
+		_botdb.Model(&QuotaCounter{}).Where("key_id = ? AND period = ?", key.Root(), quota.period).
+			Update("messages", gorm.Expr("max(messages - ?, 0)", messages))
+	}
+}
+
+// consumeQuota counts the messages of a send request against the quotas of
+// its key, the request ends with 429 when a quota would be exceeded
+func consumeQuota(c *gin.Context, messages int) bool {
+	key := requestAPIKey(c)
+	if key == nil {
+		return true
+	}
+	err := takeQuota(key, messages)
+	if exceeded, ok := err.(*quotaExceeded); ok {
+		c.Header("Retry-After", retrySeconds(exceeded.retry))
+		abortWithError(c, http.StatusTooManyRequests, CodeQuotaExceeded, exceeded.Error())
+		return false
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return false
+	}
+	return true
+}
+
+// QuotaUsage is the consumption of a quota
+type QuotaUsage struct {
+	Period string `json:"period"`
+	Used   int    `json:"used"`
+	// Limit and Remaining are omitted when the quota is unlimited
+	Limit     int       `json:"limit,omitempty"`
+	Remaining *int      `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// RateUsage is the state of the rate limit, omitted when unlimited
+type RateUsage struct {
+	PerMinute int `json:"per_minute"`
+	Remaining int `json:"remaining"`
+}
+
+// UsageResponse is the consumption of an API key
+type UsageResponse struct {
+	KeyID     uint       `json:"key_id"`
+	Details   string     `json:"details"`
+	Scopes    []string   `json:"scopes"`
+	RateLimit *RateUsage `json:"rate_limit,omitempty"`
+	Daily     QuotaUsage `json:"daily"`
+	Monthly   QuotaUsage `json:"monthly"`
+}
+
+func keyUsage(key *APIKey) UsageResponse {
+	now := time.Now()
+	usage := UsageResponse{KeyID: key.ID, Details: key.Details, Scopes: key.ScopeList()}
+	if perMinute := key.RateLimitPerMinute(); perMinute > 0 {
+		usage.RateLimit = &RateUsage{PerMinute: perMinute, Remaining: _rateLimiter.remaining(key.Root(), perMinute, now)}
+	}
+	var quotas []QuotaUsage
+	for _, quota := range quotaPeriods(key, now) {
+		used := quotaUsed(key.Root(), quota.period)
+		current := QuotaUsage{Period: quota.period, Used: used, Limit: quota.limit, ResetsAt: quota.resetsAt}
+		if quota.limit > 0 {
+			remaining := quotaLeft(quota.limit, used)
+			current.Remaining = &remaining
+		}
+		quotas = append(quotas, current)
+	}
+	usage.Daily, usage.Monthly = quotas[0], quotas[1]
+	return usage
+}
+
+// Handler function returning the usage of the API key of the request
+func getUsage(c *gin.Context) {
+	c.JSON(http.StatusOK, keyUsage(requestAPIKey(c)))
+}
+
+// Handler function returning the usage of every API key
+func listUsage(c *gin.Context) {
+	var keys []APIKey
+	if err := _keymanager.db.Order("id").Find(&keys).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	usages := []UsageResponse{}
+	for i := range keys {
+		usages = append(usages, keyUsage(&keys[i]))
+	}
+	c.JSON(http.StatusOK, usages)
+}
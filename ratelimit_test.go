@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	start := time.Date(2023, 7, 14, 10, 0, 0, 0, time.UTC)
+	// 2 requests per minute, a token every 30 seconds
+	steps := []struct {
+		after     time.Duration
+		remaining int
+		reset     time.Duration
+		retry     time.Duration
+	}{
+		{after: 0, remaining: 1, reset: 30 * time.Second},
+		{after: 0, remaining: 0, reset: time.Minute},
+		{after: 0, remaining: 0, reset: time.Minute, retry: 30 * time.Second},
+		{after: 15 * time.Second, remaining: 0, reset: 45 * time.Second, retry: 15 * time.Second},
+		{after: 30 * time.Second, remaining: 0, reset: time.Minute},
+		// the bucket never holds more than a minute of requests
+		{after: 10 * time.Minute, remaining: 1, reset: 30 * time.Second},
+	}
+	limiter := &rateLimiter{buckets: map[uint]*tokenBucket{}}
+	for i, step := range steps {
+		remaining, reset, retry := limiter.take(1, 2, start.Add(step.after))
+		if remaining != step.remaining || reset != step.reset || retry != step.retry {
+			t.Fatalf("step %d: take = %d, %s, %s, want %d, %s, %s", i, remaining, reset, retry, step.remaining, step.reset, step.retry)
+		}
+	}
+	// the keys have their own buckets
+	if remaining, _, retry := limiter.take(2, 2, start); remaining != 1 || retry != 0 {
+		t.Fatalf("take of another key = %d, %s, want a full bucket", remaining, retry)
+	}
+}
+
+func TestTakeAndRefundQuota(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(t.TempDir()+"/bot.db"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&QuotaCounter{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := _botdb
+	_botdb = db
+	defer func() { _botdb = previous }()
+
+	key := &APIKey{ID: 1, DailyQuota: 5, MonthlyQuota: -1}
+	steps := []struct {
+		name     string
+		take     int
+		refund   int
+		exceeded bool
+		used     int
+	}{
+		{name: "take", take: 3, used: 3},
+		{name: "over quota", take: 3, exceeded: true, used: 3},
+		{name: "up to the quota", take: 2, used: 5},
+		{name: "quota reached", take: 1, exceeded: true, used: 5},
+		{name: "refund", refund: 4, used: 1},
+		{name: "take after refund", take: 4, used: 5},
+		{name: "refund below zero", refund: 10, used: 0},
+	}
+	day := quotaPeriods(key, time.Now())[0].period
+	for _, step := range steps {
+		if step.refund > 0 {
+			refundQuota(key, step.refund)
+		} else {
+			err := takeQuota(key, step.take)
+			var exceeded *quotaExceeded
+			if errors.As(err, &exceeded) != step.exceeded || (err != nil && !step.exceeded) {
+				t.Fatalf("%s: takeQuota(%d) = %v, want exceeded %v", step.name, step.take, err, step.exceeded)
+			}
+		}
+		if used := quotaUsed(key.ID, day); used != step.used {
+			t.Fatalf("%s: %d messages used, want %d", step.name, used, step.used)
+		}
+	}
+}
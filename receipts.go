@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Delivery states reached by a sent recipient through receipts
+const (
+	RecipientDelivered = "delivered"
+	RecipientRead      = "read"
+)
+
+// recipientProgress orders the statuses a recipient goes through, a receipt
+// never moves a recipient backwards (a late delivery after a read)
+var recipientProgress = map[string]int{
+	RecipientSent:      1,
+	RecipientDelivered: 2,
+	RecipientRead:      3,
+}
+
+// JobCallback is the body posted to the callback URL of a job when a recipient changes status
+type JobCallback struct {
+	JobID     string    `json:"job_id"`
+	Number    string    `json:"number"`
+	MessageID string    `json:"message_id,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// receiptStatus maps a whatsmeow receipt to a recipient status, ok is false
+// for receipts that do not tell anything about the recipient.
+//
+// No receipt makes a recipient failed: the server rejects a message in the
+// response to the send, which already marks the recipient failed, and there
+// is no error receipt after that. A retry receipt only means that a device
+// could not decrypt the message, whatsmeow sends it again and the delivery
+// receipt follows.
+func receiptStatus(receiptType events.ReceiptType) (status string, ok bool) {
+	switch receiptType {
+	case events.ReceiptTypeDelivered:
+		return RecipientDelivered, true
+	case events.ReceiptTypeRead, events.ReceiptTypeReadSelf, events.ReceiptTypePlayed:
+		return RecipientRead, true
+	}
+	return "", false
+}
+
+// onReceipt updates the recipients of the messages acknowledged by a receipt
+func onReceipt(v *events.Receipt) {
+	status, ok := receiptStatus(v.Type)
+	if !ok || _botdb == nil || v.IsFromMe {
+		return
+	}
+	var recipients []JobRecipient
+	if err := _botdb.Where("message_id IN ?", v.MessageIDs).Find(&recipients).Error; err != nil {
+		fmt.Printf("Receipt error: %v\n", err)
+		return
+	}
+	for i := range recipients {
+		recipient := &recipients[i]
+		if recipientProgress[recipient.Status] >= recipientProgress[status] {
+			continue
+		}
+		timestamp := v.Timestamp
+		updates := map[string]interface{}{"status": status}
+		if status == RecipientRead {
+			updates["read_at"] = &timestamp
+			if recipient.DeliveredAt == nil {
+				updates["delivered_at"] = &timestamp
+			}
+		} else {
+			updates["delivered_at"] = &timestamp
+		}
+		if err := _botdb.Model(recipient).Updates(updates).Error; err != nil {
+			fmt.Printf("Receipt error: %v\n", err)
+			continue
+		}
+		recipient.Status = status
+		updateJobCounters(recipient.JobID)
+		notifyRecipient(recipient.JobID, recipient, timestamp)
+	}
+}
+
+// updateJobCounters recounts the delivered and read recipients of a job
+func updateJobCounters(jobID string) {
+	var delivered, read int64
+	_botdb.Model(&JobRecipient{}).Where("job_id = ? AND status IN ?", jobID, []string{RecipientDelivered, RecipientRead}).Count(&delivered)
+	_botdb.Model(&JobRecipient{}).Where("job_id = ? AND status = ?", jobID, RecipientRead).Count(&read)
+	_botdb.Model(&SendJob{}).Where("id = ?", jobID).Updates(map[string]interface{}{"delivered": delivered, "read": read})
+}
+
+// notifyRecipient posts the new status of a recipient to the callback URL of
+// its job, retried like any webhook delivery
+func notifyRecipient(jobID string, recipient *JobRecipient, timestamp time.Time) {
+	var job SendJob
+	if err := _botdb.Select("id", "callback_url").First(&job, "id = ?", jobID).Error; err != nil || job.CallbackURL == "" {
+		return
+	}
+	enqueueWebhook(0, job.CallbackURL, "", EventJobRecipient, JobCallback{
+		JobID:     jobID,
+		Number:    recipient.Number,
+		MessageID: recipient.MessageID,
+		Status:    recipient.Status,
+		Error:     recipient.Error,
+		Timestamp: timestamp,
+	})
+}
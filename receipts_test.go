@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestReceiptStatus(t *testing.T) {
+	tests := []struct {
+		receiptType events.ReceiptType
+		want        string
+		wantOK      bool
+	}{
+		{receiptType: events.ReceiptTypeDelivered, want: RecipientDelivered, wantOK: true},
+		{receiptType: events.ReceiptTypeRead, want: RecipientRead, wantOK: true},
+		{receiptType: events.ReceiptTypeReadSelf, want: RecipientRead, wantOK: true},
+		{receiptType: events.ReceiptTypePlayed, want: RecipientRead, wantOK: true},
+		{receiptType: events.ReceiptTypeSender},
+		{receiptType: events.ReceiptTypeRetry},
+		{receiptType: "inactive"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.receiptType), func(t *testing.T) {
+			got, ok := receiptStatus(test.receiptType)
+			if got != test.want || ok != test.wantOK {
+				t.Fatalf("receiptStatus(%q) = %q, %v, want %q, %v", test.receiptType, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// ChatSetting stores the per-chat preferences of the bot
+type ChatSetting struct {
+	ID           uint   `gorm:"primaryKey"`
+	Chat         string `gorm:"uniqueIndex"`
+	QuoteReplies bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// defaultQuoteReplies is used for chats without a stored setting, quoting is on unless QUOTE_REPLIES=false
+func defaultQuoteReplies() bool {
+	enabled, err := strconv.ParseBool(os.Getenv(QuoteRepliesEnvVar))
+	return err != nil || enabled
+}
+
+// quoteRepliesIn reports whether replies in the chat should quote the triggering message
+func quoteRepliesIn(chat string) bool {
+	var setting ChatSetting
+	if _botdb == nil || _botdb.Where("chat = ?", chat).First(&setting).Error != nil {
+		return defaultQuoteReplies()
+	}
+	return setting.QuoteReplies
+}
+
+// setQuoteReplies stores the quoting preference of the chat
+func setQuoteReplies(chat string, enabled bool) error {
+	var setting ChatSetting
+	_botdb.Where(ChatSetting{Chat: chat}).FirstOrInit(&setting)
+	setting.QuoteReplies = enabled
+	return _botdb.Save(&setting).Error
+}
+
+// quoteContext builds the ContextInfo pointing at the triggering message
+func quoteContext(v *events.Message) *waProto.ContextInfo {
+	return &waProto.ContextInfo{
+		StanzaId:      proto.String(v.Info.ID),
+		Participant:   proto.String(v.Info.Sender.ToNonAD().String()),
+		QuotedMessage: v.Message,
+	}
+}
+
+// quoted returns msg turned into a reply to v. Plain conversation messages
+// become ExtendedTextMessage since they cannot carry a ContextInfo.
+func quoted(v *events.Message, msg *waProto.Message) *waProto.Message {
+	ctx := quoteContext(v)
+	switch {
+	case msg.Conversation != nil:
+		return &waProto.Message{
+			ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text:        msg.Conversation,
+				ContextInfo: ctx,
+			},
+		}
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = ctx
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = ctx
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = ctx
+	}
+	return msg
+}
+
+// replyTimeout is how long a reply may wait in the outbound queue before being dropped
+const replyTimeout = 2 * time.Minute
+
+// sendReply sends msg through the outbound queue ahead of bulk messages
+func sendReply(chat types.JID, msg *waProto.Message) (whatsmeow.SendResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	return _outbox.Send(ctx, chat, msg, OutboundOptions{Priority: PriorityReply})
+}
+
+// sendEdit sends the edit of a reply, outside of the rate limits
+func sendEdit(chat types.JID, msg *waProto.Message) (whatsmeow.SendResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	return _outbox.Send(ctx, chat, msg, OutboundOptions{Priority: PriorityReply, Edit: true})
+}
+
+// reply sends msg to the chat of v, quoting v when the chat has it enabled
+func reply(client *whatsmeow.Client, v *events.Message, msg *waProto.Message) (whatsmeow.SendResponse, error) {
+	if quoteRepliesIn(v.Info.Chat.String()) {
+		msg = quoted(v, msg)
+	}
+	return sendReply(v.Info.Chat, msg)
+}
+
+// replyText is a shortcut for replying with a plain text message
+func replyText(client *whatsmeow.Client, v *events.Message, text string) (whatsmeow.SendResponse, error) {
+	return reply(client, v, &waProto.Message{
+		Conversation: proto.String(text),
+	})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"github.com/teambition/rrule-go"
+	"go.mau.fi/whatsmeow/types"
+	"gorm.io/gorm"
+)
+
+// Statuses of a schedule
+const (
+	ScheduleActive   = "active"
+	ScheduleDone     = "done"
+	ScheduleFailed   = "failed"
+	ScheduleCanceled = "canceled"
+)
+
+// Kinds of schedule, messages come from the API and reminders from the /remind command
+const (
+	ScheduleMessage  = "message"
+	ScheduleReminder = "reminder"
+)
+
+const (
+	// schedulePollInterval is how often the scheduler looks for due schedules when it was not woken up
+	schedulePollInterval = 15 * time.Second
+	// sendAtTolerance is how far in the past a send_at may be, it is then sent right away
+	sendAtTolerance = time.Minute
+)
+
+// scheduleWake is signaled when a schedule is created so the scheduler looks at it
+var scheduleWake = make(chan struct{}, 1)
+
+// ScheduledRecipient is a resolved recipient stored with its schedule
+type ScheduledRecipient struct {
+	Number  string `json:"number"`
+	JID     string `json:"jid"`
+	Message string `json:"message,omitempty"`
+}
+
+// Schedule is a message sent later, once or on a recurrence. Every run
+// queues a send job built from the stored request.
+type Schedule struct {
+	ID     string `gorm:"primaryKey"`
+	Kind   string
+	Status string `gorm:"index"`
+	Repeat string
+	// StartsAt is the first run, the DTSTART of an RRULE
+	StartsAt  time.Time
+	NextRunAt *time.Time `gorm:"index"`
+	LastRunAt *time.Time
+	LastJobID string
+	Runs      int
+	// Skipped counts the runs not sent because a quota of the key was exhausted
+	Skipped int
+	Error   string
+
+	Message         string
+	Attachments     []Attachment   `gorm:"foreignKey:OwnerID"`
+	Location        *LocationInput `gorm:"serializer:json"`
+	Contacts        []ContactInput `gorm:"serializer:json"`
+	LinkPreview     bool
+	CallbackURL     string
+	Template        string
+	TemplateVersion int
+	// Recipients is the JSON encoded list of ScheduledRecipient
+	Recipients string
+	// KeyID is the API key that created the schedule, its runs are metered to it
+	KeyID uint
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (s *Schedule) recipients() []ScheduledRecipient {
+	var recipients []ScheduledRecipient
+	json.Unmarshal([]byte(s.Recipients), &recipients)
+	return recipients
+}
+
+// ScheduleResponse is a schedule as returned by the API
+type ScheduleResponse struct {
+	ID          string               `json:"id"`
+	Kind        string               `json:"kind"`
+	Status      string               `json:"status"`
+	Repeat      string               `json:"repeat"`
+	NextRunAt   *time.Time           `json:"next_run_at"`
+	LastRunAt   *time.Time           `json:"last_run_at"`
+	LastJobID   string               `json:"last_job_id"`
+	Runs        int                  `json:"runs"`
+	Skipped     int                  `json:"skipped"`
+	Error       string               `json:"error"`
+	Message     string               `json:"message"`
+	Attachments []Attachment         `json:"attachments"`
+	Location    *LocationInput       `json:"location"`
+	Contacts    []ContactInput       `json:"contacts"`
+	LinkPreview bool                 `json:"link_preview"`
+	Template    string               `json:"template"`
+	Recipients  []ScheduledRecipient `json:"recipients"`
+	CallbackURL string               `json:"callback_url"`
+	CreatedAt   time.Time            `json:"created_at"`
+}
+
+// CanceledSchedule is the response of the cancelation of a schedule
+type CanceledSchedule struct {
+	Message    string `json:"message"`
+	ScheduleID string `json:"schedule_id"`
+}
+
+func (s *Schedule) response() ScheduleResponse {
+	return ScheduleResponse{
+		ID:          s.ID,
+		Kind:        s.Kind,
+		Status:      s.Status,
+		Repeat:      s.Repeat,
+		NextRunAt:   s.NextRunAt,
+		LastRunAt:   s.LastRunAt,
+		LastJobID:   s.LastJobID,
+		Runs:        s.Runs,
+		Skipped:     s.Skipped,
+		Error:       s.Error,
+		Message:     s.Message,
+		Attachments: s.Attachments,
+		Location:    s.Location,
+		Contacts:    s.Contacts,
+		LinkPreview: s.LinkPreview,
+		Template:    s.Template,
+		Recipients:  s.recipients(),
+		CallbackURL: s.CallbackURL,
+		CreatedAt:   s.CreatedAt,
+	}
+}
+
+// parseRecurrence parses a recurrence rule, either a cron expression ("0 9 * * 1-5",
+// "@daily", optionally prefixed with "CRON_TZ=Africa/Casablanca") or an RFC 5545
+// RRULE ("FREQ=WEEKLY;BYDAY=MO;BYHOUR=9"). start is the DTSTART of an RRULE.
+// The returned function gives the first occurrence after a time, or the zero
+// time when the recurrence is over.
+func parseRecurrence(rule string, start time.Time) (func(time.Time) time.Time, error) {
+	rule = strings.TrimSpace(rule)
+	if upper := strings.ToUpper(rule); strings.HasPrefix(upper, "RRULE:") || strings.Contains(upper, "FREQ=") {
+		option, err := rrule.StrToROption(strings.TrimPrefix(strings.TrimPrefix(rule, "RRULE:"), "rrule:"))
+		if err != nil {
+			return nil, err
+		}
+		if option.Dtstart.IsZero() {
+			option.Dtstart = start.Truncate(time.Second)
+		}
+		recurrence, err := rrule.NewRRule(*option)
+		if err != nil {
+			return nil, err
+		}
+		return func(after time.Time) time.Time {
+			return recurrence.After(after, false)
+		}, nil
+	}
+	schedule, err := cron.ParseStandard(rule)
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Next, nil
+}
+
+// createSchedule stores the resolved request to be sent at req.SendAt, then
+// on its recurrence
+func createSchedule(req *SendMessageRequest, kind string) (*Schedule, error) {
+	recipients := make([]ScheduledRecipient, len(req.recipients))
+	for i, recipient := range req.recipients {
+		recipients[i] = ScheduledRecipient{Number: recipient.Number, JID: recipient.JID.String(), Message: recipient.Message}
+	}
+	encoded, err := json.Marshal(recipients)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	next := now
+	if req.SendAt != nil && req.SendAt.After(now) {
+		next = *req.SendAt
+	} else if req.Repeat != "" {
+		recurrence, err := parseRecurrence(req.Repeat, now)
+		if err != nil {
+			return nil, err
+		}
+		if next = recurrence(now); next.IsZero() {
+			return nil, fmt.Errorf("the recurrence has no occurrence after now")
+		}
+	}
+	schedule := &Schedule{
+		ID:          uuid.NewString(),
+		Kind:        kind,
+		Status:      ScheduleActive,
+		Repeat:      req.Repeat,
+		StartsAt:    next,
+		NextRunAt:   &next,
+		Message:     req.Message,
+		Attachments: copyAttachments(req.attachments),
+		Location:    req.Location,
+		Contacts:    req.Contacts,
+		LinkPreview: req.LinkPreview,
+		CallbackURL: req.CallbackURL,
+		Recipients:  string(encoded),
+		KeyID:       req.keyID,
+	}
+	if req.template != nil {
+		schedule.Template = req.template.Name
+		schedule.TemplateVersion = req.template.Version
+	}
+	if err := _botdb.Create(schedule).Error; err != nil {
+		return nil, err
+	}
+	select {
+	case scheduleWake <- struct{}{}:
+	default:
+	}
+	return schedule, nil
+}
+
+// runSchedule queues the send job of a due schedule and moves it to its next
+// occurrence. Occurrences missed while the bot was down are not caught up,
+// the schedule runs once and continues from now.
+func runSchedule(schedule *Schedule) {
+	req := &SendMessageRequest{
+		Message:     schedule.Message,
+		CallbackURL: schedule.CallbackURL,
+		Location:    schedule.Location,
+		Contacts:    schedule.Contacts,
+		LinkPreview: schedule.LinkPreview,
+		attachments: schedule.Attachments,
+		scheduleID:  schedule.ID,
+		keyID:       schedule.KeyID,
+	}
+	if schedule.Template != "" {
+		req.template = &MessageTemplate{Name: schedule.Template, Version: schedule.TemplateVersion}
+	}
+	for _, recipient := range schedule.recipients() {
+		jid, err := types.ParseJID(recipient.JID)
+		if err != nil {
+			continue
+		}
+		req.recipients = append(req.recipients, resolvedRecipient{Number: recipient.Number, JID: jid, Message: recipient.Message})
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"last_run_at": now}
+	var key *APIKey
+	if schedule.KeyID != 0 {
+		var err error
+		if key, err = _keymanager.ActiveKey(schedule.KeyID); err != nil {
+			cancelSchedule(schedule.ID, "canceled: "+err.Error())
+			return
+		}
+	}
+	// the first run was counted when the schedule was created
+	if key != nil && schedule.Runs > 0 {
+		if err := takeQuota(key, req.quotaMessages()); err != nil {
+			updates["skipped"] = schedule.Skipped + 1
+			updates["error"] = "run skipped: " + err.Error()
+			req = nil
+		}
+	}
+	if req != nil {
+		updates["runs"] = schedule.Runs + 1
+		job, err := enqueueSendJob(req)
+		if err != nil {
+			if key != nil && schedule.Runs > 0 {
+				refundQuota(key, req.quotaMessages())
+			}
+			updates["error"] = err.Error()
+		} else {
+			updates["last_job_id"] = job.ID
+			updates["error"] = ""
+		}
+	}
+	var next time.Time
+	if schedule.Repeat != "" {
+		recurrence, err := parseRecurrence(schedule.Repeat, schedule.StartsAt)
+		if err != nil {
+			updates["status"] = ScheduleFailed
+			updates["error"] = err.Error()
+		} else {
+			next = recurrence(now)
+		}
+	}
+	if next.IsZero() {
+		updates["next_run_at"] = nil
+		if _, failed := updates["status"]; !failed {
+			updates["status"] = ScheduleDone
+		}
+	} else {
+		updates["next_run_at"] = next
+	}
+	result := _botdb.Model(schedule).Where("status = ?", ScheduleActive).Updates(updates)
+	// the jobs have their own copy of the files, a finished schedule drops its own
+	if _, finished := updates["status"]; finished && result.Error == nil && result.RowsAffected > 0 {
+		releaseAttachments(schedule.ID)
+	}
+}
+
+// cancelSchedule cancels the next runs of an active schedule and releases its files
+func cancelSchedule(id, reason string) {
+	result := _botdb.Model(&Schedule{}).Where("id = ? AND status = ?", id, ScheduleActive).
+		Updates(map[string]interface{}{"status": ScheduleCanceled, "next_run_at": nil, "error": reason})
+	if result.Error == nil && result.RowsAffected > 0 {
+		releaseAttachments(id)
+	}
+}
+
+// cancelKeyWork cancels the active schedules and the queued or running jobs
+// of an API key once every key of its rotation chain is revoked
+func cancelKeyWork(root uint) {
+	if _botdb == nil {
+		return
+	}
+	var ids []string
+	_botdb.Model(&Schedule{}).Where("key_id = ? AND status = ?", root, ScheduleActive).Pluck("id", &ids)
+	for _, id := range ids {
+		cancelSchedule(id, "canceled: API key revoked")
+	}
+	ids = nil
+	_botdb.Model(&SendJob{}).Where("key_id = ? AND status IN ?", root, []string{JobQueued, JobRunning}).Pluck("id", &ids)
+	for _, id := range ids {
+		cancelSendJob(id)
+	}
+}
+
+// startScheduler runs the due schedules. Schedules are stored in the bot
+// database so they survive restarts.
+func startScheduler() {
+	go func() {
+		for {
+			var due []Schedule
+			err := _botdb.Preload("Attachments", orderedAttachments).Where("status = ? AND next_run_at <= ?", ScheduleActive, time.Now()).Order("next_run_at").Find(&due).Error
+			if err != nil {
+				fmt.Printf("Scheduler error: %v\n", err)
+			}
+			for i := range due {
+				runSchedule(&due[i])
+			}
+			select {
+			case <-scheduleWake:
+			case <-time.After(schedulePollInterval):
+			}
+		}
+	}()
+}
+
+// parseReminderDelay parses the delay of a reminder, a Go duration ("2h",
+// "1h30m") where days and weeks ("1d", "2w") are allowed too
+func parseReminderDelay(value string) (time.Duration, error) {
+	value = strings.ToLower(value)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			count, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+			if err != nil || count <= 0 {
+				return 0, fmt.Errorf("invalid delay %q", value)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay <= 0 {
+		return 0, fmt.Errorf("invalid delay %q", value)
+	}
+	return delay, nil
+}
+
+// createReminder schedules text to be sent back to the chat after the delay
+// given by the arguments of "/remind me in 2h call the bank"
+func createReminder(chat types.JID, args []string) (*Schedule, error) {
+	if len(args) < 4 || strings.ToLower(args[0]) != "me" || strings.ToLower(args[1]) != "in" {
+		return nil, errors.New("usage: /remind me in 2h call the bank")
+	}
+	delay, err := parseReminderDelay(args[2])
+	if err != nil {
+		return nil, err
+	}
+	sendAt := time.Now().Add(delay)
+	return createSchedule(&SendMessageRequest{
+		Message:    "⏰ Reminder: " + strings.Join(args[3:], " "),
+		SendAt:     &sendAt,
+		recipients: []resolvedRecipient{{Number: chat.User, JID: chat}},
+	}, ScheduleReminder)
+}
+
+func listSchedules(c *gin.Context) {
+	query := _botdb.Preload("Attachments", orderedAttachments).Order("created_at desc")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if key := requestAPIKey(c); !key.HasScope(ScopeAdmin) {
+		query = query.Where("key_id = ?", key.Root())
+	}
+	var schedules []Schedule
+	if err := query.Find(&schedules).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	list := make([]ScheduleResponse, len(schedules))
+	for i := range schedules {
+		list[i] = schedules[i].response()
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": list})
+}
+
+func getSchedule(c *gin.Context) {
+	var schedule Schedule
+	if err := _botdb.Preload("Attachments", orderedAttachments).First(&schedule, "id = ?", c.Param("id")).Error; err != nil || !ownsResource(c, schedule.KeyID) {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Schedule not found")
+		return
+	}
+	c.JSON(http.StatusOK, schedule.response())
+}
+
+// deleteSchedule cancels the next runs of a schedule, jobs already queued by it are not affected
+func deleteSchedule(c *gin.Context) {
+	var schedule Schedule
+	if err := _botdb.First(&schedule, "id = ?", c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) || err == nil && !ownsResource(c, schedule.KeyID) {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Schedule not found")
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	if schedule.Status != ScheduleActive {
+		abortWithError(c, http.StatusConflict, CodeConflict, fmt.Sprintf("Schedule already %s", schedule.Status))
+		return
+	}
+	_botdb.Model(&schedule).Updates(map[string]interface{}{"status": ScheduleCanceled, "next_run_at": nil})
+	releaseAttachments(schedule.ID)
+	c.JSON(http.StatusOK, CanceledSchedule{Message: "Canceled", ScheduleID: schedule.ID})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	// a Friday
+	start := time.Date(2023, 7, 14, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule    string
+		after   time.Time
+		want    time.Time
+		wantErr bool
+	}{
+		{rule: "0 9 * * *", after: start, want: time.Date(2023, 7, 15, 9, 0, 0, 0, time.UTC)},
+		{rule: "0 9 * * 1-5", after: start, want: time.Date(2023, 7, 17, 9, 0, 0, 0, time.UTC)},
+		{rule: "@daily", after: start, want: time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC)},
+		{rule: "  30 10 * * *  ", after: start, want: time.Date(2023, 7, 14, 10, 30, 0, 0, time.UTC)},
+		{rule: "FREQ=WEEKLY;BYDAY=MO;BYHOUR=9;BYMINUTE=0;BYSECOND=0", after: start, want: time.Date(2023, 7, 17, 9, 0, 0, 0, time.UTC)},
+		{rule: "RRULE:FREQ=DAILY;COUNT=2", after: start, want: time.Date(2023, 7, 15, 10, 0, 0, 0, time.UTC)},
+		// the recurrence is over after its last occurrence
+		{rule: "RRULE:FREQ=DAILY;COUNT=2", after: start.AddDate(0, 0, 1)},
+		{rule: "FREQ=DAILY;UNTIL=20230716T000000Z", after: start.AddDate(0, 0, 2)},
+		{rule: "every day", wantErr: true},
+		{rule: "0 25 * * *", wantErr: true},
+		{rule: "FREQ=SOMETIMES", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			recurrence, err := parseRecurrence(test.rule, start)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseRecurrence(%q) succeeded, want an error", test.rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRecurrence(%q): %v", test.rule, err)
+			}
+			if got := recurrence(test.after); !got.Equal(test.want) {
+				t.Fatalf("next run of %q after %s = %s, want %s", test.rule, test.after, got, test.want)
+			}
+		})
+	}
+}
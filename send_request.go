@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// maxMessageLength is the maximum number of characters of a message
+	maxMessageLength = 600
+	// maxMediaSize is the maximum size of an attached file
+	maxMediaSize = 32 << 20
+)
+
+// MediaInput is a file attached to a JSON send request, given either inline
+// as base64 or as a URL the server downloads
+type MediaInput struct {
+	// Type forces how the file is sent: image, video, audio, voice, sticker
+	// or document. It is guessed from the MIME type when empty.
+	Type     string `json:"type,omitempty"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+	URL      string `json:"url"`
+}
+
+// SendMessageRequest is the body of /send-message, decoded from JSON or multipart form data
+type SendMessageRequest struct {
+	Numbers []string    `json:"numbers"`
+	Groups  []string    `json:"groups,omitempty"`
+	Message string      `json:"message"`
+	Media   *MediaInput `json:"media,omitempty"`
+	// Attachments are sent after Media, each one as its own message
+	Attachments []MediaInput   `json:"attachments,omitempty"`
+	Location    *LocationInput `json:"location,omitempty"`
+	Contacts    []ContactInput `json:"contacts,omitempty"`
+	LinkPreview bool           `json:"link_preview,omitempty"`
+	CallbackURL string         `json:"callback_url,omitempty"`
+	// SendAt delays the send, Repeat is a cron expression or RRULE repeating it
+	SendAt *time.Time `json:"send_at,omitempty"`
+	Repeat string     `json:"repeat,omitempty"`
+
+	// files decoded, downloaded or uploaded, Media first
+	attachments []Attachment
+	// numbers normalized and resolved on WhatsApp by resolveRecipients
+	recipients []resolvedRecipient
+	// template the messages were rendered from
+	template *MessageTemplate
+	// schedule queuing the job
+	scheduleID string
+	// API key of the request, the messages sent are metered to it
+	keyID uint
+}
+
+// resolvedRecipient is a normalized number and its WhatsApp JID
+type resolvedRecipient struct {
+	Number string
+	JID    types.JID
+	// Fields are the request fields naming the recipient, e.g. "numbers[0]"
+	Fields []string
+	// Message overrides the message of the request for this recipient
+	Message string
+	// InviteLink is joined once the request is accepted, the bot is not a member of its group
+	InviteLink string
+}
+
+// scheduled reports whether the request is sent later or repeatedly rather than right away
+func (r *SendMessageRequest) scheduled() bool {
+	return r.Repeat != "" || (r.SendAt != nil && r.SendAt.After(time.Now()))
+}
+
+// quotaMessages is what the request counts against the quotas, each message
+// sent to each recipient
+func (r *SendMessageRequest) quotaMessages() int {
+	content := MessageContent{Message: r.Message, Attachments: r.attachments, Location: r.Location, Contacts: r.Contacts}
+	return len(r.recipients) * partCount(content)
+}
+
+// HasFile reports whether the request carries an attachment, loaded or not
+func (r *SendMessageRequest) HasFile() bool {
+	return len(r.attachments) > 0 || r.Media != nil || len(r.Attachments) > 0
+}
+
+// requiredScopes returns the scopes the request needs on top of send:text,
+// files need send:media and invite links, which join groups, groups:manage
+func (r *SendMessageRequest) requiredScopes() []string {
+	var scopes []string
+	if r.HasFile() {
+		scopes = append(scopes, ScopeSendMedia)
+	}
+	for _, target := range append(append([]string{}, r.Numbers...), r.Groups...) {
+		if strings.HasPrefix(strings.TrimSpace(target), whatsmeow.InviteLinkPrefix) {
+			scopes = append(scopes, ScopeGroupsManage)
+			break
+		}
+	}
+	return scopes
+}
+
+// FieldErrors maps a request field to what is wrong with it
+type FieldErrors map[string]string
+
+// bindSendMessageRequest decodes the request according to its content type,
+// the media URLs are only downloaded by prepare. A nil request comes with the
+// field errors to report.
+func bindSendMessageRequest(c *gin.Context) (*SendMessageRequest, FieldErrors) {
+	var req *SendMessageRequest
+	var errs FieldErrors
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch contentType {
+	case "application/json":
+		req, errs = bindJSONSendRequest(c)
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		req, errs = bindFormSendRequest(c)
+	default:
+		return nil, FieldErrors{"body": fmt.Sprintf("unsupported content type %q, use application/json or multipart/form-data", contentType)}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return req, nil
+}
+
+// prepare downloads the media of a bound request and validates it, once its
+// scopes are checked
+func (r *SendMessageRequest) prepare() FieldErrors {
+	if errs := r.loadMedia(); len(errs) > 0 {
+		return errs
+	}
+	return r.validate()
+}
+
+func bindJSONSendRequest(c *gin.Context) (*SendMessageRequest, FieldErrors) {
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return nil, FieldErrors{"body": fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	return &req, nil
+}
+
+// loadMedia decodes or downloads the attachments described by Media and Attachments
+func (r *SendMessageRequest) loadMedia() FieldErrors {
+	errs := FieldErrors{}
+	inputs := r.Attachments
+	fields := make([]string, len(inputs))
+	for i := range inputs {
+		fields[i] = fmt.Sprintf("attachments[%d]", i)
+	}
+	if r.Media != nil {
+		inputs = append([]MediaInput{*r.Media}, inputs...)
+		fields = append([]string{"media"}, fields...)
+	}
+	for i, input := range inputs {
+		attachment, err := loadMediaInput(input, fields[i])
+		if err != nil {
+			errs[err.field] = err.message
+			continue
+		}
+		r.attachments = append(r.attachments, attachment)
+	}
+	return errs
+}
+
+type mediaError struct {
+	field, message string
+}
+
+// loadMediaInput decodes or downloads one attachment of a JSON request
+func loadMediaInput(input MediaInput, field string) (Attachment, *mediaError) {
+	attachment := Attachment{Kind: input.Type, field: field}
+	switch {
+	case input.Data != "" && input.URL != "":
+		return attachment, &mediaError{field, "set either data or url, not both"}
+	case input.Data != "":
+		data, err := base64.StdEncoding.DecodeString(input.Data)
+		if err != nil {
+			return attachment, &mediaError{field + ".data", "must be base64 encoded"}
+		}
+		attachment.Data = data
+	case input.URL != "":
+		data, mimeType, err := downloadMedia(input.URL)
+		if err != nil {
+			return attachment, &mediaError{field + ".url", err.Error()}
+		}
+		attachment.Data = data
+		if input.MimeType == "" {
+			input.MimeType = mimeType
+		}
+		if input.Filename == "" {
+			if u, err := url.Parse(input.URL); err == nil {
+				input.Filename = path.Base(u.Path)
+			}
+		}
+	default:
+		return attachment, &mediaError{field, "data or url is required"}
+	}
+	attachment.Filename = input.Filename
+	attachment.MimeType = input.MimeType
+	if attachment.MimeType == "" && attachment.Filename != "" {
+		attachment.MimeType = mime.TypeByExtension(path.Ext(attachment.Filename))
+	}
+	return attachment, nil
+}
+
+func bindFormSendRequest(c *gin.Context) (*SendMessageRequest, FieldErrors) {
+	if err := c.Request.ParseMultipartForm(maxMediaSize); err != nil && err != http.ErrNotMultipart {
+		return nil, FieldErrors{"body": "invalid form data"}
+	}
+	req := &SendMessageRequest{
+		Message:     c.Request.FormValue("message"),
+		Numbers:     splitNumbers(c.Request.Form["numbers"]),
+		Groups:      c.Request.Form["groups"],
+		CallbackURL: c.Request.FormValue("callback_url"),
+		Repeat:      c.Request.FormValue("repeat"),
+		LinkPreview: c.Request.FormValue("link_preview") == "true",
+	}
+	if sendAt := c.Request.FormValue("send_at"); sendAt != "" {
+		at, err := time.Parse(time.RFC3339, sendAt)
+		if err != nil {
+			return nil, FieldErrors{"send_at": "must be an RFC 3339 time, e.g. 2023-07-01T09:00:00Z"}
+		}
+		req.SendAt = &at
+	}
+	if c.Request.MultipartForm == nil {
+		return req, nil
+	}
+	// Every file is sent, given as repeated "file" or "files" fields
+	for _, name := range []string{"file", "files"} {
+		for i, header := range c.Request.MultipartForm.File[name] {
+			field := fmt.Sprintf("%s[%d]", name, i)
+			file, err := header.Open()
+			if err != nil {
+				return nil, FieldErrors{field: "failed to read the file"}
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return nil, FieldErrors{field: "failed to read the file"}
+			}
+			req.attachments = append(req.attachments, Attachment{
+				Filename: header.Filename,
+				MimeType: header.Header.Get("Content-Type"),
+				Data:     data,
+				field:    field,
+			})
+		}
+	}
+	return req, nil
+}
+
+// validate checks the decoded fields, the attachment included
+func (r *SendMessageRequest) validate() FieldErrors {
+	errs := FieldErrors{}
+	if len(r.Numbers) == 0 && len(r.Groups) == 0 {
+		errs["numbers"] = "at least one number or group is required"
+	}
+	if len([]rune(r.Message)) > maxMessageLength {
+		errs["message"] = fmt.Sprintf("exceeds the maximum length of %d characters", maxMessageLength)
+	}
+	if r.CallbackURL != "" {
+		if err := checkPublicURL(r.CallbackURL); err != nil {
+			errs["callback_url"] = err.Error()
+		}
+	}
+	if r.SendAt != nil && r.SendAt.Before(time.Now().Add(-sendAtTolerance)) {
+		errs["send_at"] = "must be in the future"
+	}
+	if r.Repeat != "" {
+		if _, err := parseRecurrence(r.Repeat, time.Now()); err != nil {
+			errs["repeat"] = fmt.Sprintf("invalid cron expression or RRULE: %v", err)
+		}
+	}
+	if r.Message == "" && !r.HasFile() && r.Location == nil && len(r.Contacts) == 0 {
+		errs["message"] = "message is required when no file, location or contact is sent"
+	}
+	if len(r.attachments) > maxAttachments {
+		errs["attachments"] = fmt.Sprintf("at most %d files can be sent at once", maxAttachments)
+	}
+	for i := range r.attachments {
+		attachment := &r.attachments[i]
+		attachment.Position = i
+		attachment.Size = len(attachment.Data)
+		kind, err := attachmentKind(attachment.MimeType, attachment.Kind)
+		switch {
+		case attachment.Size > maxMediaSize:
+			errs[attachment.field] = fmt.Sprintf("file exceeds the maximum size of %d MB", maxMediaSize>>20)
+		case err != nil:
+			errs[attachment.field] = err.Error()
+		default:
+			attachment.Kind = kind
+		}
+	}
+	if location := r.Location; location != nil {
+		if location.Latitude < -90 || location.Latitude > 90 || location.Longitude < -180 || location.Longitude > 180 {
+			errs["location"] = "latitude must be within [-90, 90] and longitude within [-180, 180]"
+		}
+	}
+	for i, contact := range r.Contacts {
+		field := fmt.Sprintf("contacts[%d]", i)
+		if contact.VCard != "" {
+			if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(contact.VCard)), "BEGIN:VCARD") {
+				errs[field+".vcard"] = "must be a vCard starting with BEGIN:VCARD"
+			}
+			continue
+		}
+		if contact.Name == "" {
+			errs[field+".name"] = "name is required without a vcard"
+		}
+		if _, err := normalizePhone(contact.Phone); err != nil {
+			errs[field+".phone"] = err.Error()
+		}
+	}
+	return errs
+}
+
+// splitNumbers flattens the form numbers given as separate values or as one
+// whitespace or comma separated string
+func splitNumbers(values []string) []string {
+	var numbers []string
+	for _, value := range values {
+		numbers = append(numbers, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\n' || r == '\t' || r == '\r'
+		})...)
+	}
+	return numbers
+}
+
+// downloadMedia fetches a URL-referenced attachment, bounded by maxMediaSize
+func downloadMedia(mediaURL string) ([]byte, string, error) {
+	u, err := url.Parse(mediaURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", fmt.Errorf("must be an absolute http(s) URL")
+	}
+	resp, err := publicHTTPClient(30 * time.Second).Get(u.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download failed with status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMediaSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("download failed: %v", err)
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return data, mimeType, nil
+}
+
+// sharedAddressSpace is 100.64.0.0/10, the carrier-grade NAT range
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicAddress reports whether an IP is on the internet rather than on the
+// network of the server: loopback, private, link-local, multicast and
+// unspecified addresses are not
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// checkPublicURL checks that a URL the bot posts to later, like a webhook
+// or a callback, is an absolute http(s) URL whose host resolves to public
+// addresses only. The addresses are checked again on delivery.
+func checkPublicURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an absolute http(s) URL")
+	}
+	ips := []net.IP{net.ParseIP(u.Hostname())}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(u.Hostname()); err != nil {
+			return fmt.Errorf("host %s cannot be resolved", u.Hostname())
+		}
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return fmt.Errorf("host %s is not a public address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// publicHTTPClient fetches the URLs given by API clients. The address of each
+// connection is checked once the host is resolved, redirects included, so a
+// URL cannot reach the services next to the bot.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		// no proxy, the dialer must see the address of the host
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to a %s URL is not allowed", req.URL.Scheme)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
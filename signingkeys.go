@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningKey is the public half of a key that signed API keys, kept after
+// private_key.pem is rolled so that the tokens it signed stay valid until
+// the key is retired. Tokens name their signing key in the kid header.
+type SigningKey struct {
+	KID       string `gorm:"primaryKey;column:kid"`
+	PublicKey string // PEM encoded
+	// Legacy is the key of the tokens signed before kid headers, which have none
+	Legacy    bool
+	RetiredAt *time.Time
+	CreatedAt time.Time
+}
+
+// signingKeyID derives the kid of a key from its public key
+func signingKeyID(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// registerSigningKey makes the key sign the new tokens and adds it to the
+// known keys. The first key registered is the one of the tokens without kid.
+func (m *APIKeyManager) registerSigningKey(privateKey *rsa.PrivateKey) error {
+	kid, err := signingKeyID(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	var count int64
+	m.db.Model(&SigningKey{}).Count(&count)
+	key := SigningKey{
+		KID:       kid,
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Legacy:    count == 0,
+	}
+	if err := m.db.Where(SigningKey{KID: kid}).FirstOrCreate(&key).Error; err != nil {
+		return err
+	}
+	if key.RetiredAt != nil {
+		// a retired key put back in private_key.pem signs again
+		if err := m.db.Model(&key).Update("retired_at", nil).Error; err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.privateKey, m.kid = privateKey, kid
+	m.mu.Unlock()
+	return m.loadSigningKeys()
+}
+
+// loadSigningKeys loads the public keys of the signing keys not retired
+func (m *APIKeyManager) loadSigningKeys() error {
+	var keys []SigningKey
+	if err := m.db.Where("retired_at IS NULL").Find(&keys).Error; err != nil {
+		return err
+	}
+	publicKeys := map[string]*rsa.PublicKey{}
+	legacy := ""
+	for _, key := range keys {
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(key.PublicKey))
+		if err != nil {
+			return fmt.Errorf("signing key %s: %v", key.KID, err)
+		}
+		publicKeys[key.KID] = publicKey
+		if key.Legacy {
+			legacy = key.KID
+		}
+	}
+	m.mu.Lock()
+	m.publicKeys, m.legacyKID = publicKeys, legacy
+	m.mu.Unlock()
+	return nil
+}
+
+// verificationKey is the jwt.Keyfunc of the API keys, it returns the public
+// key named by the kid header of the token
+func (m *APIKeyManager) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = m.legacyKID
+	}
+	key, ok := m.publicKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown or retired signing key %q", kid)
+	}
+	return key, nil
+}
+
+// sign signs the claims with the current signing key
+func (m *APIKeyManager) sign(claims jwt.MapClaims) (string, error) {
+	m.mu.RLock()
+	privateKey, kid := m.privateKey, m.kid
+	m.mu.RUnlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(privateKey)
+}
+
+// RotateSigningKey replaces private_key.pem with a new key, which signs the
+// new tokens. The tokens of the previous key stay valid until it is retired.
+func (m *APIKeyManager) RotateSigningKey() (string, error) {
+	privateKey, err := generatePrivateKey()
+	if err != nil {
+		return "", err
+	}
+	if err := savePrivateKey(privateKey); err != nil {
+		return "", err
+	}
+	if err := m.registerSigningKey(privateKey); err != nil {
+		return "", err
+	}
+	return m.currentKID(), nil
+}
+
+// signingPrivateKey is the key signing the new tokens, rsaKeyPair is only
+// the key loaded at startup
+func (m *APIKeyManager) signingPrivateKey() *rsa.PrivateKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.privateKey
+}
+
+// currentKID is the kid of the key signing the new tokens
+func (m *APIKeyManager) currentKID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.kid
+}
+
+// RetireSigningKey stops accepting the tokens signed by a key, the current
+// key cannot be retired
+func (m *APIKeyManager) RetireSigningKey(kid string) error {
+	if kid == m.currentKID() {
+		return fmt.Errorf("the signing key %s is the current one, rotate it first", kid)
+	}
+	result := m.db.Model(&SigningKey{}).Where("kid = ? AND retired_at IS NULL", kid).Update("retired_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("unknown or retired signing key %q", kid)
+	}
+	return m.loadSigningKeys()
+}
+
+// signingKeys lists the signing keys, the latest first
+func (m *APIKeyManager) signingKeys() []SigningKey {
+	var keys []SigningKey
+	m.db.Order("created_at desc").Find(&keys)
+	return keys
+}
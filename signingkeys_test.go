@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rsa"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestVerificationKey(t *testing.T) {
+	var publicKeys []*rsa.PublicKey
+	for i := 0; i < 2; i++ {
+		privateKey, err := generatePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeys = append(publicKeys, &privateKey.PublicKey)
+	}
+	manager := &APIKeyManager{publicKeys: map[string]*rsa.PublicKey{"legacy": publicKeys[0], "current": publicKeys[1]}, legacyKID: "legacy"}
+	noLegacy := &APIKeyManager{publicKeys: map[string]*rsa.PublicKey{"current": publicKeys[1]}}
+	tests := []struct {
+		name    string
+		manager *APIKeyManager
+		method  jwt.SigningMethod
+		kid     string
+		want    *rsa.PublicKey
+	}{
+		{name: "kid", manager: manager, method: jwt.SigningMethodRS256, kid: "current", want: publicKeys[1]},
+		{name: "no kid", manager: manager, method: jwt.SigningMethodRS256, want: publicKeys[0]},
+		{name: "no kid without legacy key", manager: noLegacy, method: jwt.SigningMethodRS256},
+		{name: "unknown or retired kid", manager: manager, method: jwt.SigningMethodRS256, kid: "retired"},
+		{name: "HMAC token", manager: manager, method: jwt.SigningMethodHS256, kid: "current"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := jwt.New(test.method)
+			if test.kid != "" {
+				token.Header["kid"] = test.kid
+			}
+			got, err := test.manager.verificationKey(token)
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("verificationKey = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("verificationKey = %v, %v, want the key of %q", got, err, test.kid)
+			}
+		})
+	}
+}
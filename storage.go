@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Backends of the received media, set with MEDIA_STORAGE
+const (
+	StorageDisk = "disk"
+	StorageS3   = "s3"
+	StorageNone = "none"
+)
+
+// defaultMediaDir is where received media are stored on disk
+const defaultMediaDir = "media"
+
+// defaultMediaMaxBytes is the largest received file stored, set with MEDIA_MAX_BYTES
+const defaultMediaMaxBytes = 32 << 20
+
+// MediaStore keeps the files of received media
+type MediaStore interface {
+	Put(ctx context.Context, key string, data []byte, mimeType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// diskMediaStore stores files in a local directory
+type diskMediaStore struct {
+	dir string
+}
+
+func (s *diskMediaStore) Put(ctx context.Context, key string, data []byte, mimeType string) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	// written aside then renamed so a file is never read half written
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, key))
+}
+
+func (s *diskMediaStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.Base(key)))
+}
+
+// s3MediaStore stores files in a bucket of an S3 compatible storage (AWS S3, MinIO...)
+type s3MediaStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3MediaStore) Put(ctx context.Context, key string, data []byte, mimeType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: mimeType})
+	return err
+}
+
+func (s *s3MediaStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, Stat reports a missing object
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+// newS3MediaStore connects to the bucket set in the S3_* variables and creates it when missing
+func newS3MediaStore() (*s3MediaStore, error) {
+	endpoint, bucket := os.Getenv(S3EndpointEnvVar), os.Getenv(S3BucketEnvVar)
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("%s and %s are required", S3EndpointEnvVar, S3BucketEnvVar)
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv(S3AccessKeyEnvVar), os.Getenv(S3SecretKeyEnvVar), ""),
+		Secure: os.Getenv(S3UseSSLEnvVar) != "false",
+		Region: os.Getenv(S3RegionEnvVar),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv(S3RegionEnvVar)}); err != nil {
+			return nil, err
+		}
+	}
+	return &s3MediaStore{client: client, bucket: bucket}, nil
+}
+
+var (
+	_mediaStore   MediaStore
+	_mediaStorage string
+)
+
+// initMediaStore sets up the storage of received media, on disk by default
+func initMediaStore() {
+	_mediaStorage = strings.ToLower(os.Getenv(MediaStorageEnvVar))
+	switch _mediaStorage {
+	case "", StorageDisk:
+		dir := os.Getenv(MediaDirEnvVar)
+		if dir == "" {
+			dir = defaultMediaDir
+		}
+		_mediaStorage, _mediaStore = StorageDisk, &diskMediaStore{dir: dir}
+	case StorageS3:
+		store, err := newS3MediaStore()
+		if err != nil {
+			fmt.Printf("Media storage error, received media are not stored: %v\n", err)
+			_mediaStorage = StorageNone
+			return
+		}
+		_mediaStore = store
+	case StorageNone:
+	default:
+		fmt.Printf("Unknown %s %q, received media are not stored\n", MediaStorageEnvVar, _mediaStorage)
+		_mediaStorage = StorageNone
+	}
+}
+
+// StoredMedia is the file of a received message, kept in the media storage
+type StoredMedia struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	MessageID string    `gorm:"index" json:"message_id"`
+	Chat      string    `json:"chat"`
+	Sender    string    `json:"sender"`
+	Type      string    `json:"type"`
+	MimeType  string    `json:"mime_type"`
+	FileName  string    `json:"file_name,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `gorm:"index" json:"sha256"`
+	Storage   string    `json:"-"`
+	Key       string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// downloadableMedia returns the media of a message that can be downloaded, if any
+func downloadableMedia(v *events.Message) whatsmeow.DownloadableMessage {
+	msg := v.Message
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage()
+	}
+	return nil
+}
+
+// storableMedia checks the kind and the announced size of a received media
+// against MEDIA_KINDS, the comma separated kinds to store (every kind when
+// unset), and MEDIA_MAX_BYTES (0 for no limit)
+func storableMedia(kind string, size uint64) error {
+	if kinds := os.Getenv(MediaKindsEnvVar); kinds != "" && !contains(strings.Split(strings.ReplaceAll(kinds, " ", ""), ","), kind) {
+		return fmt.Errorf("%s media are not stored", kind)
+	}
+	if limit := envInt(MediaMaxBytesEnvVar, defaultMediaMaxBytes); limit > 0 && size > uint64(limit) {
+		return fmt.Errorf("%s of %d bytes exceeds the %d bytes limit", kind, size, limit)
+	}
+	return nil
+}
+
+// storeReceivedMedia downloads the media of a received message into the
+// media storage and links it to the message in the history. A file already
+// stored with the same hash is not stored twice. The size is checked before
+// the download, which whatsmeow does in memory, and again after it as the
+// announced size comes from the sender.
+func storeReceivedMedia(client *whatsmeow.Client, v *events.Message) {
+	media := downloadableMedia(v)
+	if media == nil || _mediaStore == nil || v.Info.IsFromMe {
+		return
+	}
+	incoming := newIncomingMessage(v)
+	if err := storableMedia(incoming.Type, incoming.FileSize); err != nil {
+		fmt.Printf("Media not stored: %v\n", err)
+		return
+	}
+	data, err := client.Download(media)
+	if err != nil {
+		fmt.Printf("Media download error: %v\n", err)
+		return
+	}
+	if err := storableMedia(incoming.Type, uint64(len(data))); err != nil {
+		fmt.Printf("Media not stored: %v\n", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	stored := StoredMedia{
+		ID:        uuid.NewString(),
+		MessageID: incoming.ID,
+		Chat:      incoming.Chat,
+		Sender:    incoming.Sender,
+		Type:      incoming.Type,
+		MimeType:  incoming.MimeType,
+		FileName:  incoming.FileName,
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Storage:   _mediaStorage,
+	}
+	var existing StoredMedia
+	if err := _botdb.Where("sha256 = ? AND storage = ?", stored.SHA256, stored.Storage).First(&existing).Error; err == nil {
+		stored.Key = existing.Key
+	} else {
+		stored.Key = stored.SHA256
+		if extensions, _ := mime.ExtensionsByType(stored.MimeType); len(extensions) > 0 {
+			stored.Key += extensions[0]
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := _mediaStore.Put(ctx, stored.Key, data, stored.MimeType)
+		cancel()
+		if err != nil {
+			fmt.Printf("Media storage error: %v\n", err)
+			return
+		}
+	}
+	if err := _botdb.Create(&stored).Error; err != nil {
+		fmt.Printf("Media storage error: %v\n", err)
+		return
+	}
+	_botdb.Model(&ChatMessage{}).Where("message_id = ? AND chat = ?", stored.MessageID, stored.Chat).Update("media_id", stored.ID)
+}
+
+// Handler function returning the file of a received media
+func getMedia(c *gin.Context) {
+	var stored StoredMedia
+	if err := _botdb.First(&stored, "id = ?", c.Param("id")).Error; err != nil {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Media not found")
+		return
+	}
+	etag := `"` + stored.SHA256 + `"`
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if _mediaStore == nil || stored.Storage != _mediaStorage {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Media stored in %s, which is not configured", stored.Storage))
+		return
+	}
+	file, err := _mediaStore.Open(c.Request.Context(), stored.Key)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Failed to read the media: %v", err))
+		return
+	}
+	defer file.Close()
+	recordUsage(UsageEntry{KeyID: requestKeyID(c), Action: UsageMediaDownload, Reference: stored.ID, MediaBytes: stored.Size})
+	sum, _ := hex.DecodeString(stored.SHA256)
+	headers := map[string]string{
+		"ETag":   etag,
+		"Digest": "sha-256=" + base64.StdEncoding.EncodeToString(sum),
+	}
+	if stored.FileName != "" {
+		headers["Content-Disposition"] = mime.FormatMediaType("attachment", map[string]string{"filename": stored.FileName})
+	}
+	c.DataFromReader(http.StatusOK, stored.Size, stored.MimeType, file, headers)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// streamPlaceholder is the text of the message sent before the first tokens arrive
+	streamPlaceholder = "…"
+	// defaultStreamInterval is the minimum delay between two edits of the same message
+	defaultStreamInterval = 1500 * time.Millisecond
+)
+
+// estimatePromptTokens approximates the prompt tokens of a request, which the
+// streaming API does not report: about 4 characters per token, plus the
+// tokens framing each message and priming the reply
+func estimatePromptTokens(messages []openai.ChatCompletionMessage) int {
+	tokens := 3
+	for _, message := range messages {
+		tokens += 4 + (len(message.Role)+len(message.Content)+len(message.Name)+3)/4
+	}
+	return tokens
+}
+
+// streamingEnabled reports whether replies should be streamed through message edits
+func streamingEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv(StreamRepliesEnvVar))
+	return err == nil && enabled
+}
+
+// streamInterval returns the configured edit throttle, never going below one second
+func streamInterval() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv(StreamIntervalEnvVar))
+	if err != nil || ms <= 0 {
+		return defaultStreamInterval
+	}
+	interval := time.Duration(ms) * time.Millisecond
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval
+}
+
+// GenerateGPTResponseStream works like GenerateGPTResponse but consumes the
+// streaming API, calling onDelta with the accumulated text after every chunk.
+func GenerateGPTResponseStream(input string, user string, gpt *openai.Client, onDelta func(string)) (string, error) {
+	_allmessages := chatHistory(user)
+	_allmessages = append(_allmessages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: input,
+	})
+	_req[user] = openai.ChatCompletionRequest{
+		Model:    openai.GPT3Dot5Turbo,
+		Messages: _allmessages,
+	}
+	request := _req[user]
+	request.Stream = true
+	stream, err := gpt.CreateChatCompletionStream(context.Background(), request)
+	if err != nil {
+		return "", fmt.Errorf("chatCompletionStream error: %v", err)
+	}
+	defer stream.Close()
+
+	// each chunk of the stream carries one token of the completion
+	var content strings.Builder
+	completionTokens := 0
+	defer func() {
+		recordUsage(UsageEntry{Action: UsageReply, Reference: chatReference(user), LLMTokens: estimatePromptTokens(request.Messages) + completionTokens})
+	}()
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return content.String(), fmt.Errorf("chatCompletionStream error: %v", err)
+		}
+		if len(resp.Choices) == 0 || resp.Choices[0].Delta.Content == "" {
+			continue
+		}
+		completionTokens++
+		content.WriteString(resp.Choices[0].Delta.Content)
+		if onDelta != nil {
+			onDelta(content.String())
+		}
+	}
+	_allmessages = append(_allmessages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: content.String(),
+	})
+	_req[user] = openai.ChatCompletionRequest{
+		Model:    openai.GPT3Dot5Turbo,
+		Messages: _allmessages,
+	}
+	return content.String(), nil
+}
+
+// streamGPTReply replies to v with a placeholder and progressively edits it
+// while the completion is streamed, finishing with the final text.
+func streamGPTReply(client *whatsmeow.Client, v *events.Message, input string, gpt *openai.Client) error {
+	chat := v.Info.Chat
+	placeholder, err := replyText(client, v, streamPlaceholder)
+	if err != nil {
+		return err
+	}
+	// edits keep the message type of the placeholder
+	quoting := quoteRepliesIn(chat.String())
+	edit := func(text string) error {
+		content := &waProto.Message{Conversation: proto.String(text)}
+		if quoting {
+			content = &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(text)}}
+		}
+		_, err := sendEdit(chat, client.BuildEdit(chat, placeholder.ID, content))
+		return err
+	}
+
+	// the partial texts are edited in the background so that the stream is
+	// not held by the outbox, an edit still waiting is replaced by the next
+	pending := make(chan string, 1)
+	edited := make(chan struct{})
+	go func() {
+		defer close(edited)
+		for text := range pending {
+			if err := edit(text + " " + streamPlaceholder); err != nil {
+				fmt.Printf("Edit error: %v\n", err)
+			}
+		}
+	}()
+	interval := streamInterval()
+	lastEdit := time.Now()
+	lastText := streamPlaceholder
+	response, err := GenerateGPTResponseStream(input, v.Info.Sender.String(), gpt, func(text string) {
+		if time.Since(lastEdit) < interval || text == lastText {
+			return
+		}
+		select {
+		case <-pending:
+		default:
+		}
+		pending <- text
+		lastEdit = time.Now()
+		lastText = text
+	})
+	close(pending)
+	<-edited
+	if err != nil {
+		if len(response) == 0 {
+			return edit(fmt.Sprintf("__%s__", err.Error()))
+		}
+		edit(response)
+		return err
+	}
+	if len(response) == 0 {
+		return edit("__empty response__")
+	}
+	recordAnswer(placeholder.ID, v, input, response)
+	return edit(response)
+}
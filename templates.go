@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoAdminGroup/go-admin/context"
+	"github.com/GoAdminGroup/go-admin/template/types"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	// placeholderPattern matches the {{name}} placeholders of a template, spaces inside the braces are allowed
+	placeholderPattern  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*\}\}`)
+	templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// MessageTemplate is one version of a named message template. Saving a
+// template never changes a stored version, it adds the next one.
+type MessageTemplate struct {
+	ID      uint   `gorm:"primaryKey"`
+	Name    string `gorm:"uniqueIndex:idx_template_version"`
+	Version int    `gorm:"uniqueIndex:idx_template_version"`
+	Body    string
+	// Variables is the comma separated list of the placeholders of Body
+	Variables string
+	CreatedAt time.Time
+}
+
+// VariableNames returns the placeholders of the template
+func (t *MessageTemplate) VariableNames() []string {
+	if t.Variables == "" {
+		return []string{}
+	}
+	return strings.Split(t.Variables, ",")
+}
+
+// TemplateRequest is the body of POST /templates
+type TemplateRequest struct {
+	Name string `json:"name"`
+	Body string `json:"body"`
+}
+
+// TemplateResponse is one version of a template as returned by the API
+type TemplateResponse struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	Body      string    `json:"body"`
+	Variables []string  `json:"variables"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (t *MessageTemplate) response() TemplateResponse {
+	return TemplateResponse{
+		Name:      t.Name,
+		Version:   t.Version,
+		Body:      t.Body,
+		Variables: t.VariableNames(),
+		CreatedAt: t.CreatedAt,
+	}
+}
+
+// templateVariables lists the placeholders of a body once each, in order of appearance
+func templateVariables(body string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// renderTemplate replaces the placeholders of body by their variables. The
+// names of the placeholders without a variable are returned as missing.
+func renderTemplate(body string, variables map[string]string) (string, []string) {
+	var missing []string
+	for _, name := range templateVariables(body) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", missing
+	}
+	return placeholderPattern.ReplaceAllStringFunc(body, func(placeholder string) string {
+		return variables[placeholderPattern.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+// saveTemplate stores body as the next version of the template name
+func saveTemplate(name, body string) (*MessageTemplate, FieldErrors) {
+	errs := FieldErrors{}
+	name = strings.TrimSpace(name)
+	if !templateNamePattern.MatchString(name) {
+		errs["name"] = "must be 1 to 64 lowercase letters, digits, dashes or underscores"
+	}
+	switch {
+	case strings.TrimSpace(body) == "":
+		errs["body"] = "body is required"
+	case len([]rune(body)) > maxMessageLength:
+		errs["body"] = fmt.Sprintf("exceeds the maximum length of %d characters", maxMessageLength)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	tmpl := &MessageTemplate{
+		Name:      name,
+		Body:      body,
+		Variables: strings.Join(templateVariables(body), ","),
+	}
+	err := _botdb.Transaction(func(tx *gorm.DB) error {
+		var latest MessageTemplate
+		if err := tx.Where("name = ?", name).Order("version desc").First(&latest).Error; err == nil {
+			tmpl.Version = latest.Version
+		}
+		tmpl.Version++
+		return tx.Create(tmpl).Error
+	})
+	if err != nil {
+		return nil, FieldErrors{"body": fmt.Sprintf("failed to save the template: %v", err)}
+	}
+	return tmpl, nil
+}
+
+// getTemplate loads a version of a template, the latest one when version is 0
+func getTemplate(name string, version int) (*MessageTemplate, error) {
+	var tmpl MessageTemplate
+	query := _botdb.Where("name = ?", name)
+	if version > 0 {
+		query = query.Where("version = ?", version)
+	}
+	if err := query.Order("version desc").First(&tmpl).Error; err != nil {
+		return nil, err
+	}
+	return &tmpl, nil
+}
+
+// latestTemplates returns the latest version of every template
+func latestTemplates() ([]MessageTemplate, error) {
+	var templates []MessageTemplate
+	err := _botdb.Where("id IN (?)", _botdb.Model(&MessageTemplate{}).Select("max(id)").Group("name")).
+		Order("name").Find(&templates).Error
+	return templates, err
+}
+
+func createTemplate(c *gin.Context) {
+	var body TemplateRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortWithFields(c, FieldErrors{"body": fmt.Sprintf("invalid JSON: %v", err)})
+		return
+	}
+	tmpl, errs := saveTemplate(body.Name, body.Body)
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+	c.JSON(http.StatusCreated, tmpl.response())
+}
+
+func listTemplates(c *gin.Context) {
+	templates, err := latestTemplates()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	list := make([]TemplateResponse, len(templates))
+	for i := range templates {
+		list[i] = templates[i].response()
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": list})
+}
+
+// getTemplateVersions returns every version of a template, the latest first
+func getTemplateVersions(c *gin.Context) {
+	var templates []MessageTemplate
+	if err := _botdb.Where("name = ?", c.Param("name")).Order("version desc").Find(&templates).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	if len(templates) == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Template not found")
+		return
+	}
+	versions := make([]TemplateResponse, len(templates))
+	for i := range templates {
+		versions[i] = templates[i].response()
+	}
+	c.JSON(http.StatusOK, gin.H{"name": templates[0].Name, "versions": versions})
+}
+
+// TemplateRecipient is a recipient of /send-template with its own variables
+type TemplateRecipient struct {
+	Number    string            `json:"number,omitempty"`
+	Group     string            `json:"group,omitempty"`
+	Variables map[string]string `json:"variables"`
+}
+
+// TemplateSendRequest is the body of /send-template
+type TemplateSendRequest struct {
+	Template string `json:"template"`
+	// Version pins a template version, the latest is used when it is 0
+	Version int `json:"version,omitempty"`
+	// Variables are shared by every recipient, which can override them
+	Variables   map[string]string   `json:"variables,omitempty"`
+	Recipients  []TemplateRecipient `json:"recipients"`
+	Media       *MediaInput         `json:"media,omitempty"`
+	Attachments []MediaInput        `json:"attachments,omitempty"`
+	Location    *LocationInput      `json:"location,omitempty"`
+	Contacts    []ContactInput      `json:"contacts,omitempty"`
+	LinkPreview bool                `json:"link_preview,omitempty"`
+	CallbackURL string              `json:"callback_url,omitempty"`
+	SendAt      *time.Time          `json:"send_at,omitempty"`
+	Repeat      string              `json:"repeat,omitempty"`
+}
+
+// render renders the template for every recipient and turns the request into
+// a SendMessageRequest. fields maps the fields of the returned request, like
+// "numbers[0]", to the recipient fields of the template request.
+func (r *TemplateSendRequest) render(tmpl *MessageTemplate) (req *SendMessageRequest, messages []string, fields map[string]string, errs FieldErrors) {
+	errs = FieldErrors{}
+	req = &SendMessageRequest{
+		Message:     tmpl.Body,
+		Media:       r.Media,
+		Attachments: r.Attachments,
+		Location:    r.Location,
+		Contacts:    r.Contacts,
+		LinkPreview: r.LinkPreview,
+		CallbackURL: r.CallbackURL,
+		SendAt:      r.SendAt,
+		Repeat:      r.Repeat,
+		template:    tmpl,
+	}
+	messages = make([]string, len(r.Recipients))
+	fields = map[string]string{}
+	for i, recipient := range r.Recipients {
+		field := fmt.Sprintf("recipients[%d]", i)
+		variables := map[string]string{}
+		for name, value := range r.Variables {
+			variables[name] = value
+		}
+		for name, value := range recipient.Variables {
+			variables[name] = value
+		}
+		message, missing := renderTemplate(tmpl.Body, variables)
+		switch {
+		case len(missing) > 0:
+			errs[field+".variables"] = "missing variables: " + strings.Join(missing, ", ")
+		case len([]rune(message)) > maxMessageLength:
+			errs[field] = fmt.Sprintf("rendered message exceeds the maximum length of %d characters", maxMessageLength)
+		}
+		messages[i] = message
+
+		number, group := strings.TrimSpace(recipient.Number), strings.TrimSpace(recipient.Group)
+		switch {
+		case (number == "") == (group == ""):
+			errs[field] = "set either number or group"
+		case number != "":
+			fields[fmt.Sprintf("numbers[%d]", len(req.Numbers))] = field + ".number"
+			req.Numbers = append(req.Numbers, number)
+		default:
+			fields[fmt.Sprintf("groups[%d]", len(req.Groups))] = field + ".group"
+			req.Groups = append(req.Groups, group)
+		}
+	}
+	return req, messages, fields, errs
+}
+
+// recipientIndex returns the index of the template recipient behind a field of fields
+func recipientIndex(field string) int {
+	index, _ := strconv.Atoi(field[strings.Index(field, "[")+1 : strings.Index(field, "]")])
+	return index
+}
+
+// remap renames the fields of errs with fields, unknown fields are kept
+func remap(errs FieldErrors, fields map[string]string) FieldErrors {
+	remapped := FieldErrors{}
+	for field, err := range errs {
+		if renamed, ok := fields[field]; ok {
+			field = renamed
+		}
+		remapped[field] = err
+	}
+	return remapped
+}
+
+// sendTemplate renders a template for each recipient and queues the messages as one job
+func sendTemplate(c *gin.Context) {
+	var body TemplateSendRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortWithFields(c, FieldErrors{"body": fmt.Sprintf("invalid JSON: %v", err)})
+		return
+	}
+	if body.Template == "" {
+		abortWithFields(c, FieldErrors{"template": "template is required"})
+		return
+	}
+	tmpl, err := getTemplate(body.Template, body.Version)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Unknown template %q or version", body.Template))
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	if len(body.Recipients) == 0 {
+		abortWithFields(c, FieldErrors{"recipients": "at least one recipient is required"})
+		return
+	}
+
+	req, messages, fields, errs := body.render(tmpl)
+	// checked before any media URL is downloaded
+	for _, scope := range req.requiredScopes() {
+		if !requireScope(c, scope) {
+			return
+		}
+	}
+	for field, err := range req.prepare() {
+		errs[field] = err
+	}
+	if len(errs) > 0 {
+		abortWithFields(c, remap(errs, fields))
+		return
+	}
+
+	if !requireConnection(c) {
+		return
+	}
+
+	// Every recipient must resolve and get a single message before the job starts
+	errs = remap(resolveRecipients(req), fields)
+	for i := range req.recipients {
+		recipient := &req.recipients[i]
+		first := recipientIndex(fields[recipient.Fields[0]])
+		recipient.Message = messages[first]
+		for _, field := range recipient.Fields[1:] {
+			if other := recipientIndex(fields[field]); messages[other] != recipient.Message {
+				errs[fmt.Sprintf("recipients[%d]", other)] = fmt.Sprintf("same recipient as recipients[%d] with a different message", first)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+
+	queueSendRequest(c, req)
+}
+
+// GetTemplatePanel lists the templates with their versions and edits them by saving a new version
+func GetTemplatePanel(ctx *context.Context) (types.Panel, error) {
+	var templates []MessageTemplate
+	if err := _botdb.Order("name, version desc").Find(&templates).Error; err != nil {
+		return types.Panel{}, err
+	}
+	// the form is filled with the latest version of the template being edited
+	name, body := ctx.Query("edit"), ""
+	if name != "" {
+		if tmpl, err := getTemplate(name, 0); err == nil {
+			body = tmpl.Body
+		}
+	}
+	var content strings.Builder
+	if message := ctx.Query("error"); message != "" {
+		content.WriteString(fmt.Sprintf("<div class=\"alert alert-danger\">%s</div>", template.HTMLEscapeString(message)))
+	}
+	content.WriteString(fmt.Sprintf(`<form method="post" action="/admin/templates/save">%s
+<div class="form-group"><label>Name</label><input class="form-control" name="name" value="%s"></div>
+<div class="form-group"><label>Body</label><textarea class="form-control" name="body" rows="4">%s</textarea>
+<p class="help-block">Placeholders are written {{name}}, saving an existing name adds a new version.</p></div>
+<button type="submit" class="btn btn-primary">Save</button></form>`, csrfField(_adminTokens.AddToken()), template.HTMLEscapeString(name), template.HTMLEscapeString(body)))
+	content.WriteString("<h4>Templates</h4><table class=\"table table-bordered\"><tr><th>Name</th><th>Version</th><th>Variables</th><th>Body</th><th>Created</th><th></th></tr>")
+	for _, tmpl := range templates {
+		content.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td><a href=\"/admin/info/templates?edit=%s\">Edit</a></td></tr>",
+			template.HTMLEscapeString(tmpl.Name), tmpl.Version, template.HTMLEscapeString(tmpl.Variables),
+			template.HTMLEscapeString(tmpl.Body), tmpl.CreatedAt.Format(time.RFC3339), url.QueryEscape(tmpl.Name)))
+	}
+	content.WriteString("</table>")
+	return types.Panel{
+		Content:     template.HTML(content.String()),
+		Title:       "Templates",
+		Description: "Message templates and their versions",
+	}, nil
+}
+
+// saveTemplateForm saves the template posted by the admin panel as a new version
+func saveTemplateForm(ctx *context.Context) {
+	location := "/admin/info/templates"
+	if err := checkCSRF(ctx); err != nil {
+		location += "?edit=" + url.QueryEscape(ctx.FormValue("name")) + "&error=" + url.QueryEscape(err.Error())
+	} else if _, errs := saveTemplate(ctx.FormValue("name"), ctx.FormValue("body")); len(errs) > 0 {
+		var messages []string
+		for field, err := range errs {
+			messages = append(messages, field+": "+err)
+		}
+		sort.Strings(messages)
+		location += "?edit=" + url.QueryEscape(ctx.FormValue("name")) + "&error=" + url.QueryEscape(strings.Join(messages, ", "))
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": location}, "")
+}
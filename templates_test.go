@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		variables   map[string]string
+		want        string
+		wantMissing []string
+	}{
+		{name: "no placeholder", body: "Hello", want: "Hello"},
+		{name: "variables", body: "Hi {{name}}, order {{order_id}} ships today", variables: map[string]string{"name": "Sara", "order_id": "42"}, want: "Hi Sara, order 42 ships today"},
+		{name: "spaces in braces", body: "Hi {{ name }}", variables: map[string]string{"name": "Sara"}, want: "Hi Sara"},
+		{name: "repeated variable", body: "{{a}}-{{a}}", variables: map[string]string{"a": "x"}, want: "x-x"},
+		{name: "empty value", body: "Hi {{name}}!", variables: map[string]string{"name": ""}, want: "Hi !"},
+		{name: "unused variables", body: "Hi", variables: map[string]string{"name": "Sara"}, want: "Hi"},
+		{name: "not a placeholder", body: "{{1st}} {name}", want: "{{1st}} {name}"},
+		{name: "missing", body: "{{a}} {{b}} {{a}} {{c}}", variables: map[string]string{"b": "x"}, wantMissing: []string{"a", "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, missing := renderTemplate(test.body, test.variables)
+			if !reflect.DeepEqual(missing, test.wantMissing) {
+				t.Fatalf("missing = %v, want %v", missing, test.wantMissing)
+			}
+			if got != test.want {
+				t.Fatalf("renderTemplate(%q) = %q, want %q", test.body, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	// defaultToolMaxSteps bounds the number of tool calls made for a single message
+	defaultToolMaxSteps = 5
+	// maxFetchBytes is how much of a fetched page is handed back to the model
+	maxFetchBytes = 8 << 10
+	// toolModel supports function calling, it also continues the conversations using tools
+	toolModel = openai.GPT3Dot5Turbo0613
+)
+
+// ToolContext gives tools access to the conversation that triggered them
+type ToolContext struct {
+	Client *whatsmeow.Client
+	Event  *events.Message
+	GPT    *openai.Client
+}
+
+// Tool is a Go function advertised to the model through function calling
+type Tool struct {
+	Definition openai.FunctionDefine
+	// Run receives the JSON arguments chosen by the model and returns the
+	// result fed back to it
+	Run func(tc *ToolContext, arguments string) (string, error)
+}
+
+var toolRegistry = map[string]Tool{}
+
+// RegisterTool makes a tool available to the model, replacing any tool of the same name
+func RegisterTool(tool Tool) {
+	toolRegistry[tool.Definition.Name] = tool
+}
+
+// enabledTools returns the registered tools listed in GPT_TOOLS, "all" enables every tool
+func enabledTools() []Tool {
+	names := strings.FieldsFunc(os.Getenv(GPTToolsEnvVar), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	var tools []Tool
+	if contains(names, "all") {
+		for _, tool := range toolRegistry {
+			tools = append(tools, tool)
+		}
+	} else {
+		for _, name := range names {
+			if tool, ok := toolRegistry[name]; ok {
+				tools = append(tools, tool)
+			}
+		}
+	}
+	sort.Slice(tools, func(i, j int) bool {
+		return tools[i].Definition.Name < tools[j].Definition.Name
+	})
+	return tools
+}
+
+// toolsEnabled reports whether at least one tool is advertised to the model
+func toolsEnabled() bool {
+	return len(enabledTools()) > 0
+}
+
+func toolMaxSteps() int {
+	steps, err := strconv.Atoi(os.Getenv(ToolMaxStepsEnvVar))
+	if err != nil || steps <= 0 {
+		return defaultToolMaxSteps
+	}
+	return steps
+}
+
+// GenerateGPTToolResponse works like GenerateGPTResponse but lets the model
+// call the enabled tools. Tool results are fed back until the model answers
+// with text or the step limit is reached, at which point functions are no
+// longer offered so it has to answer.
+func GenerateGPTToolResponse(input string, tc *ToolContext, gpt *openai.Client) (string, error) {
+	user := tc.Event.Info.Sender.String()
+	tools := enabledTools()
+	definitions := make([]*openai.FunctionDefine, len(tools))
+	for i := range tools {
+		definitions[i] = &tools[i].Definition
+	}
+
+	_allmessages := chatHistory(user)
+	_allmessages = append(_allmessages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: input,
+	})
+	maxSteps := toolMaxSteps()
+	for step := 0; ; step++ {
+		request := openai.ChatCompletionRequest{
+			Model:    toolModel,
+			Messages: _allmessages,
+		}
+		if step < maxSteps {
+			request.Functions = definitions
+		}
+		resp, err := gpt.CreateChatCompletion(context.Background(), request)
+		if err != nil {
+			return "", fmt.Errorf("chatCompletion error: %v", err)
+		}
+		recordUsage(UsageEntry{Action: UsageReply, Reference: chatReference(user), LLMTokens: resp.Usage.TotalTokens})
+		message := resp.Choices[0].Message
+		_allmessages = append(_allmessages, message)
+		if message.FunctionCall == nil {
+			_req[user] = openai.ChatCompletionRequest{
+				Model:    toolModel,
+				Messages: _allmessages,
+			}
+			return message.Content, nil
+		}
+		_allmessages = append(_allmessages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleFunction,
+			Name:    message.FunctionCall.Name,
+			Content: runTool(tc, message.FunctionCall),
+		})
+	}
+}
+
+// runTool executes a function call, errors are reported to the model as the result
+func runTool(tc *ToolContext, call *openai.FunctionCall) string {
+	tool, ok := toolRegistry[call.Name]
+	if !ok {
+		return fmt.Sprintf("error: unknown function %q", call.Name)
+	}
+	// the arguments may hold what the user wrote, only the name is logged
+	fmt.Printf("Tool call: %s\n", call.Name)
+	result, err := tool.Run(tc, call.Arguments)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	return result
+}
+
+// stringParams builds the parameters schema of a tool taking only string arguments
+func stringParams(required []string, properties map[string]string) *openai.FunctionParams {
+	params := &openai.FunctionParams{
+		Type:       openai.JSONSchemaTypeObject,
+		Properties: map[string]*openai.JSONSchemaDefine{},
+		Required:   required,
+	}
+	for name, description := range properties {
+		params.Properties[name] = &openai.JSONSchemaDefine{
+			Type:        openai.JSONSchemaTypeString,
+			Description: description,
+		}
+	}
+	return params
+}
+
+// toolArguments decodes the JSON arguments of a call into a string map. The
+// model may send numbers or booleans for string parameters, e.g. "count": 2,
+// they are converted to their text.
+func toolArguments(arguments string) (map[string]string, error) {
+	values := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(arguments), &values); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	args := make(map[string]string, len(values))
+	for name, value := range values {
+		if value != nil {
+			args[name] = fmt.Sprint(value)
+		}
+	}
+	return args, nil
+}
+
+func init() {
+	RegisterTool(Tool{
+		Definition: openai.FunctionDefine{
+			Name:        "current_time",
+			Description: "Get the current date and time",
+			Parameters: stringParams(nil, map[string]string{
+				"timezone": "IANA time zone name, e.g. Africa/Casablanca. Defaults to UTC",
+			}),
+		},
+		Run: currentTimeTool,
+	})
+	RegisterTool(Tool{
+		Definition: openai.FunctionDefine{
+			Name:        "calculator",
+			Description: "Evaluate an arithmetic expression with + - * / % ^ and parentheses",
+			Parameters: stringParams([]string{"expression"}, map[string]string{
+				"expression": "The expression to evaluate, e.g. (2+3)*4",
+			}),
+		},
+		Run: calculatorTool,
+	})
+	RegisterTool(Tool{
+		Definition: openai.FunctionDefine{
+			Name:        "search_document",
+			Description: "Answer a question from the CSV document the user shared earlier",
+			Parameters: stringParams([]string{"question"}, map[string]string{
+				"question": "The question to ask about the document",
+			}),
+		},
+		Run: searchDocumentTool,
+	})
+	RegisterTool(Tool{
+		Definition: openai.FunctionDefine{
+			Name:        "send_image",
+			Description: "Search the web for images and send them to the user",
+			Parameters: stringParams([]string{"query"}, map[string]string{
+				"query": "What the images should show",
+				"count": "How many images to send, 1 to 4. Defaults to 1",
+			}),
+		},
+		Run: sendImageTool,
+	})
+	RegisterTool(Tool{
+		Definition: openai.FunctionDefine{
+			Name:        "http_fetch",
+			Description: "Fetch the content of a web page, only allow-listed hosts can be fetched",
+			Parameters: stringParams([]string{"url"}, map[string]string{
+				"url": "The absolute http(s) URL to fetch",
+			}),
+		},
+		Run: httpFetchTool,
+	})
+}
+
+func currentTimeTool(tc *ToolContext, arguments string) (string, error) {
+	args, err := toolArguments(arguments)
+	if err != nil {
+		return "", err
+	}
+	location := time.UTC
+	if name := args["timezone"]; name != "" {
+		if location, err = time.LoadLocation(name); err != nil {
+			return "", err
+		}
+	}
+	return time.Now().In(location).Format(time.RFC1123Z), nil
+}
+
+func calculatorTool(tc *ToolContext, arguments string) (string, error) {
+	args, err := toolArguments(arguments)
+	if err != nil {
+		return "", err
+	}
+	result, err := evalExpression(args["expression"])
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+func searchDocumentTool(tc *ToolContext, arguments string) (string, error) {
+	args, err := toolArguments(arguments)
+	if err != nil {
+		return "", err
+	}
+	return askdocument(tc.GPT, args["question"], tc.Event.Info.Sender.String())
+}
+
+func sendImageTool(tc *ToolContext, arguments string) (string, error) {
+	args, err := toolArguments(arguments)
+	if err != nil {
+		return "", err
+	}
+	count, err := strconv.Atoi(args["count"])
+	if err != nil || count <= 0 {
+		count = 1
+	} else if count > 4 {
+		count = 4
+	}
+	sent, err := sendImageResults(tc.Client, tc.Event, args["query"], count)
+	if err != nil && sent == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%d image(s) sent to the user", sent), nil
+}
+
+// fetchAllowed reports whether the host of u is listed in GPT_TOOLS_FETCH_ALLOWLIST
+func fetchAllowed(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range strings.Split(os.Getenv(FetchAllowlistEnvVar), ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed != "" && (host == allowed || strings.HasSuffix(host, "."+allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func httpFetchTool(tc *ToolContext, arguments string) (string, error) {
+	args, err := toolArguments(arguments)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(args["url"])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("invalid url %q", args["url"])
+	}
+	if !fetchAllowed(u) {
+		return "", fmt.Errorf("host %s is not allowed", u.Hostname())
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !fetchAllowed(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("HTTP %d\n%s", resp.StatusCode, body), nil
+}
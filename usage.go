@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/GoAdminGroup/go-admin/context"
+	"github.com/GoAdminGroup/go-admin/template/types"
+	"github.com/gin-gonic/gin"
+)
+
+// Metered actions of the usage ledger
+const (
+	// UsageSend is a send job, metered once it is over with what was actually sent
+	UsageSend = "send"
+	// UsageMediaDownload is a received media downloaded from /media
+	UsageMediaDownload = "media_download"
+	// UsageReply is a reply of the bot, metered with the LLM tokens it used
+	UsageReply = "reply"
+)
+
+var monthPattern = regexp.MustCompile(`^\d{4}-(0[1-9]|1[0-2])$`)
+
+// UsageEntry is a line of the usage ledger, one metered action of an API key.
+// Only sends (templates and schedule runs included), media downloads and the
+// replies of the bot are metered. The replies are not made with an API key
+// and have KeyID 0.
+type UsageEntry struct {
+	ID     uint `gorm:"primaryKey"`
+	KeyID  uint `gorm:"index"`
+	Action string
+	// Reference is the job or the media of the action, or the hash of the
+	// chat of a reply
+	Reference  string
+	Messages   int
+	Recipients int
+	MediaBytes int64
+	LLMTokens  int
+	// Month is the UTC month of the action ("2006-01"), the billing period
+	Month     string `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// recordUsage adds an entry to the ledger, entries without any quantity are dropped
+func recordUsage(entry UsageEntry) {
+	if entry.Messages == 0 && entry.Recipients == 0 && entry.MediaBytes == 0 && entry.LLMTokens == 0 {
+		return
+	}
+	if _botdb == nil {
+		return
+	}
+	entry.Month = time.Now().UTC().Format("2006-01")
+	if err := _botdb.Create(&entry).Error; err != nil {
+		fmt.Printf("Usage ledger error: %v\n", err)
+	}
+}
+
+// chatReference is the reference of a reply, the chat is hashed so that the
+// exports of the ledger do not hold phone numbers
+func chatReference(jid string) string {
+	sum := sha256.Sum256([]byte(jid))
+	return "chat:" + hex.EncodeToString(sum[:8])
+}
+
+// requestKeyID returns the root ID of the API key of the request, 0 when
+// there is none
+func requestKeyID(c *gin.Context) uint {
+	if key := requestAPIKey(c); key != nil {
+		return key.Root()
+	}
+	return 0
+}
+
+// UsageAggregate is the usage of an API key over a month
+type UsageAggregate struct {
+	Month      string `json:"month"`
+	KeyID      uint   `json:"key_id"`
+	Details    string `json:"details"`
+	Actions    int    `json:"actions"`
+	Messages   int    `json:"messages"`
+	Recipients int    `json:"recipients"`
+	MediaBytes int64  `json:"media_bytes"`
+	LLMTokens  int    `json:"llm_tokens"`
+}
+
+// monthlyUsage sums the ledger by month and key, the latest month first. An
+// empty month returns every month.
+func monthlyUsage(month string) ([]UsageAggregate, error) {
+	query := _botdb.Model(&UsageEntry{}).
+		Select("month, key_id, count(*) AS actions, sum(messages) AS messages, sum(recipients) AS recipients, sum(media_bytes) AS media_bytes, sum(llm_tokens) AS llm_tokens").
+		Group("month, key_id").Order("month desc, key_id")
+	if month != "" {
+		query = query.Where("month = ?", month)
+	}
+	aggregates := []UsageAggregate{}
+	if err := query.Scan(&aggregates).Error; err != nil {
+		return nil, err
+	}
+	// the keys are in their own database
+	var keys []APIKey
+	if _keymanager != nil {
+		_keymanager.db.Find(&keys)
+	}
+	details := map[uint]string{0: "Bot (replies and reminders)"}
+	for _, key := range keys {
+		details[key.ID] = key.Details
+	}
+	for i := range aggregates {
+		aggregates[i].Details = details[aggregates[i].KeyID]
+	}
+	return aggregates, nil
+}
+
+// GetUsagePanel shows the monthly usage of each key, ?month=2006-01 selects a month
+func GetUsagePanel(ctx *context.Context) (types.Panel, error) {
+	month := ctx.Query("month")
+	if month != "" && !monthPattern.MatchString(month) {
+		month = ""
+	}
+	aggregates, err := monthlyUsage(month)
+	if err != nil {
+		return types.Panel{}, err
+	}
+	var content bytes.Buffer
+	content.WriteString(fmt.Sprintf(`<form method="get" action="/admin/info/usage" class="form-inline">
+<input class="form-control" type="month" name="month" value="%s"> <button type="submit" class="btn btn-default">Filter</button>
+<a class="btn btn-primary" href="/admin/usage/export?format=csv&month=%s">Export CSV</a>
+<a class="btn btn-primary" href="/admin/usage/export?format=json&month=%s">Export JSON</a></form>`,
+		month, url.QueryEscape(month), url.QueryEscape(month)))
+	content.WriteString("<table class=\"table table-bordered\"><tr><th>Month</th><th>Key</th><th>Details</th><th>Actions</th><th>Messages</th><th>Recipients</th><th>Media bytes</th><th>LLM tokens</th></tr>")
+	for _, usage := range aggregates {
+		content.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td></tr>",
+			usage.Month, usage.KeyID, template.HTMLEscapeString(usage.Details), usage.Actions, usage.Messages, usage.Recipients, usage.MediaBytes, usage.LLMTokens))
+	}
+	content.WriteString("</table>")
+	return types.Panel{
+		Content:     template.HTML(content.String()),
+		Title:       "Usage",
+		Description: "Monthly usage of each API key",
+	}, nil
+}
+
+// exportUsage downloads the monthly usage as CSV or JSON (?format=csv|json),
+// ?month=2006-01 exports a single month
+func exportUsage(ctx *context.Context) {
+	month := ctx.Query("month")
+	if month != "" && !monthPattern.MatchString(month) {
+		ctx.JSON(http.StatusBadRequest, map[string]interface{}{"error": "month must be formatted 2006-01"})
+		return
+	}
+	aggregates, err := monthlyUsage(month)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	name := "usage"
+	if month != "" {
+		name += "-" + month
+	}
+	if ctx.Query("format") == "json" {
+		body, _ := json.MarshalIndent(aggregates, "", "  ")
+		ctx.DataWithHeaders(http.StatusOK, map[string]string{
+			"Content-Type":        "application/json",
+			"Content-Disposition": fmt.Sprintf("attachment; filename=%q", name+".json"),
+		}, body)
+		return
+	}
+	var body bytes.Buffer
+	writer := csv.NewWriter(&body)
+	writer.Write([]string{"month", "key_id", "details", "actions", "messages", "recipients", "media_bytes", "llm_tokens"})
+	for _, usage := range aggregates {
+		writer.Write([]string{
+			usage.Month,
+			strconv.FormatUint(uint64(usage.KeyID), 10),
+			usage.Details,
+			strconv.Itoa(usage.Actions),
+			strconv.Itoa(usage.Messages),
+			strconv.Itoa(usage.Recipients),
+			strconv.FormatInt(usage.MediaBytes, 10),
+			strconv.Itoa(usage.LLMTokens),
+		})
+	}
+	writer.Flush()
+	ctx.DataWithHeaders(http.StatusOK, map[string]string{
+		"Content-Type":        "text/csv",
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", name+".csv"),
+	}, body.Bytes())
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoAdminGroup/go-admin/context"
+	"github.com/GoAdminGroup/go-admin/template/types"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Event types a webhook can subscribe to, "*" subscribes to all of them
+const (
+	EventMessage    = "message"
+	EventReceipt    = "receipt"
+	EventGroupJoin  = "group.join"
+	EventConnection = "connection"
+	EventPresence   = "presence"
+	// EventJobRecipient is only posted to the callback URL of a send job
+	EventJobRecipient = "job.recipient"
+)
+
+var webhookEventTypes = []string{EventMessage, EventReceipt, EventGroupJoin, EventConnection, EventPresence}
+
+// Statuses of a webhook delivery, dead deliveries form the dead-letter table
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	defaultWebhookMaxAttempts = 8
+	webhookBaseBackoff        = 10 * time.Second
+	webhookMaxBackoff         = time.Hour
+	webhookPollInterval       = 2 * time.Second
+	// webhookWorkers is how many URLs are posted to at the same time
+	webhookWorkers = 8
+	// SignatureHeader carries the hex HMAC-SHA256 of the body keyed with the subscription secret
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookSubscription posts the chosen event types to an URL
+type WebhookSubscription struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	URL        string    `json:"url"`
+	EventTypes string    `json:"-"`
+	Secret     string    `json:"-"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Events returns the event types the subscription receives
+func (s *WebhookSubscription) Events() []string {
+	return strings.Split(s.EventTypes, ",")
+}
+
+// WebhookResponse is a subscription as returned by the API, its secret is
+// only returned when it is created
+type WebhookResponse struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *WebhookSubscription) response() WebhookResponse {
+	return WebhookResponse{ID: s.ID, URL: s.URL, Events: s.Events(), Active: s.Active, CreatedAt: s.CreatedAt}
+}
+
+// Wants reports whether the subscription receives the event type
+func (s *WebhookSubscription) Wants(event string) bool {
+	events := s.Events()
+	return contains(events, "*") || contains(events, event)
+}
+
+// WebhookDelivery is one event posted to one URL, retried with exponential
+// backoff until it is delivered or runs out of attempts
+type WebhookDelivery struct {
+	ID             uint `gorm:"primaryKey"`
+	SubscriptionID uint `gorm:"index"`
+	URL            string
+	Secret         string
+	Event          string
+	Payload        []byte
+	Status         string `gorm:"index"`
+	Attempts       int
+	LastError      string
+	NextAttemptAt  time.Time `gorm:"index"`
+	DeliveredAt    *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// WebhookEvent is the JSON body posted to webhooks
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// IncomingMessage describes a received message
+type IncomingMessage struct {
+	ID        string    `json:"id"`
+	Chat      string    `json:"chat"`
+	Sender    string    `json:"sender"`
+	PushName  string    `json:"push_name,omitempty"`
+	IsGroup   bool      `json:"is_group"`
+	Type      string    `json:"type"`
+	Text      string    `json:"text,omitempty"`
+	MimeType  string    `json:"mime_type,omitempty"`
+	FileName  string    `json:"file_name,omitempty"`
+	FileSize  uint64    `json:"file_size,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// newIncomingMessage extracts the fields of a message event shared with integrators
+func newIncomingMessage(v *events.Message) IncomingMessage {
+	msg := v.Message
+	incoming := IncomingMessage{
+		ID:        v.Info.ID,
+		Chat:      v.Info.Chat.String(),
+		Sender:    v.Info.Sender.ToNonAD().String(),
+		PushName:  v.Info.PushName,
+		IsGroup:   v.Info.IsGroup,
+		Timestamp: v.Info.Timestamp,
+	}
+	switch {
+	case msg.GetConversation() != "":
+		incoming.Type, incoming.Text = "text", msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		incoming.Type, incoming.Text = "text", msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		incoming.Type, incoming.Text = "image", msg.GetImageMessage().GetCaption()
+		incoming.MimeType = msg.GetImageMessage().GetMimetype()
+		incoming.FileSize = msg.GetImageMessage().GetFileLength()
+	case msg.GetDocumentMessage() != nil:
+		incoming.Type, incoming.Text = "document", msg.GetDocumentMessage().GetCaption()
+		incoming.MimeType = msg.GetDocumentMessage().GetMimetype()
+		incoming.FileSize = msg.GetDocumentMessage().GetFileLength()
+		incoming.FileName = msg.GetDocumentMessage().GetFileName()
+	case msg.GetVideoMessage() != nil:
+		incoming.Type, incoming.Text = "video", msg.GetVideoMessage().GetCaption()
+		incoming.MimeType = msg.GetVideoMessage().GetMimetype()
+		incoming.FileSize = msg.GetVideoMessage().GetFileLength()
+	case msg.GetAudioMessage() != nil:
+		incoming.Type = "audio"
+		incoming.MimeType = msg.GetAudioMessage().GetMimetype()
+		incoming.FileSize = msg.GetAudioMessage().GetFileLength()
+	case msg.GetStickerMessage() != nil:
+		incoming.Type = "sticker"
+		incoming.MimeType = msg.GetStickerMessage().GetMimetype()
+		incoming.FileSize = msg.GetStickerMessage().GetFileLength()
+	case msg.GetLocationMessage() != nil:
+		incoming.Type = "location"
+		incoming.Text = fmt.Sprintf("%f,%f", msg.GetLocationMessage().GetDegreesLatitude(), msg.GetLocationMessage().GetDegreesLongitude())
+	case msg.GetContactMessage() != nil:
+		incoming.Type, incoming.Text = "contact", msg.GetContactMessage().GetVcard()
+	case msg.GetReactionMessage() != nil:
+		incoming.Type, incoming.Text = "reaction", msg.GetReactionMessage().GetText()
+	default:
+		incoming.Type = "other"
+	}
+	return incoming
+}
+
+// webhookPayload maps a whatsmeow event to the event type and data posted
+// to webhooks, ok is false for events that are not forwarded
+func webhookPayload(evt interface{}) (event string, data interface{}, ok bool) {
+	switch v := evt.(type) {
+	case *events.Message:
+		if v.Info.IsFromMe {
+			return "", nil, false
+		}
+		return EventMessage, newIncomingMessage(v), true
+	case *events.Receipt:
+		return EventReceipt, gin.H{
+			"chat":        v.Chat.String(),
+			"sender":      v.Sender.ToNonAD().String(),
+			"message_ids": v.MessageIDs,
+			"type":        receiptTypeName(v.Type),
+			"timestamp":   v.Timestamp,
+		}, true
+	case *events.JoinedGroup:
+		return EventGroupJoin, gin.H{
+			"group":        v.JID.String(),
+			"name":         v.Name,
+			"participants": []string{botJID()},
+			"by_bot":       true,
+		}, true
+	case *events.GroupInfo:
+		if len(v.Join) == 0 {
+			return "", nil, false
+		}
+		participants := make([]string, len(v.Join))
+		for i, jid := range v.Join {
+			participants[i] = jid.String()
+		}
+		return EventGroupJoin, gin.H{
+			"group":        v.JID.String(),
+			"participants": participants,
+			"by_bot":       false,
+		}, true
+	case *events.Presence:
+		presence := gin.H{"from": v.From.ToNonAD().String(), "state": "available"}
+		if v.Unavailable {
+			presence["state"] = "unavailable"
+		}
+		if !v.LastSeen.IsZero() {
+			presence["last_seen"] = v.LastSeen
+		}
+		return EventPresence, presence, true
+	case *events.ChatPresence:
+		return EventPresence, gin.H{
+			"chat":     v.Chat.String(),
+			"from":     v.Sender.ToNonAD().String(),
+			"state":    string(v.State),
+			"media":    string(v.Media),
+			"is_group": v.IsGroup,
+		}, true
+	case *events.Connected:
+		return EventConnection, gin.H{"state": "connected"}, true
+	case *events.Disconnected:
+		return EventConnection, gin.H{"state": "disconnected"}, true
+	case *events.LoggedOut:
+		return EventConnection, gin.H{"state": "logged_out"}, true
+	case *events.StreamReplaced:
+		return EventConnection, gin.H{"state": "stream_replaced"}, true
+	case *events.TemporaryBan:
+		return EventConnection, gin.H{"state": "temporary_ban", "reason": v.String()}, true
+	case *events.ConnectFailure:
+		return EventConnection, gin.H{"state": "connect_failure", "reason": v.Reason.String()}, true
+	}
+	return "", nil, false
+}
+
+func receiptTypeName(t events.ReceiptType) string {
+	if t == events.ReceiptTypeDelivered {
+		return "delivered"
+	}
+	return string(t)
+}
+
+// botJID returns the JID of the logged in account
+func botJID() string {
+	if WhatsappCl.client == nil || WhatsappCl.client.Store.ID == nil {
+		return ""
+	}
+	return WhatsappCl.client.Store.ID.ToNonAD().String()
+}
+
+// dispatchWebhooks queues the event for every active subscription wanting it
+func dispatchWebhooks(evt interface{}) {
+	event, data, ok := webhookPayload(evt)
+	if !ok || _botdb == nil {
+		return
+	}
+	var subscriptions []WebhookSubscription
+	if err := _botdb.Where("active = ?", true).Find(&subscriptions).Error; err != nil {
+		fmt.Printf("Webhook error: %v\n", err)
+		return
+	}
+	for _, subscription := range subscriptions {
+		if subscription.Wants(event) {
+			enqueueWebhook(subscription.ID, subscription.URL, subscription.Secret, event, data)
+		}
+	}
+}
+
+// enqueueWebhook stores a delivery of the event, sent by the delivery worker
+func enqueueWebhook(subscriptionID uint, url string, secret string, event string, data interface{}) {
+	body, err := json.Marshal(WebhookEvent{
+		ID:        uuid.NewString(),
+		Event:     event,
+		Timestamp: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		fmt.Printf("Webhook error: %v\n", err)
+		return
+	}
+	delivery := WebhookDelivery{
+		SubscriptionID: subscriptionID,
+		URL:            url,
+		Secret:         secret,
+		Event:          event,
+		Payload:        body,
+		Status:         DeliveryPending,
+		NextAttemptAt:  time.Now(),
+	}
+	if err := _botdb.Create(&delivery).Error; err != nil {
+		fmt.Printf("Webhook error: %v\n", err)
+	}
+}
+
+// signPayload returns the hex HMAC-SHA256 of the body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the delay before the next attempt after attempts failures
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+// postWebhook makes one delivery attempt, any non 2xx answer is a failure
+func postWebhook(client *http.Client, delivery *WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	if delivery.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+signPayload(delivery.Secret, delivery.Payload))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliverWebhook makes an attempt of a delivery and schedules the next one
+// when it fails
+func deliverWebhook(client *http.Client, delivery *WebhookDelivery, maxAttempts int) {
+	delivery.Attempts++
+	if err := postWebhook(client, delivery); err != nil {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= maxAttempts {
+			delivery.Status = DeliveryDead
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts))
+		}
+	} else {
+		now := time.Now()
+		delivery.Status = DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	}
+	_botdb.Save(delivery)
+}
+
+// startWebhookWorker delivers the due webhook deliveries. The deliveries of
+// an URL are posted in order, and up to webhookWorkers URLs at the same time
+// so that a slow endpoint does not hold back the others.
+func startWebhookWorker() {
+	maxAttempts := envInt(WebhookMaxAttemptsEnvVar, defaultWebhookMaxAttempts)
+	// subscriptions and callbacks are URLs given by API clients
+	client := publicHTTPClient(10 * time.Second)
+	var mu sync.Mutex
+	busy := map[string]bool{}
+	workers := make(chan struct{}, webhookWorkers)
+	go func() {
+		for {
+			query := _botdb.Where("status = ? AND next_attempt_at <= ?", DeliveryPending, time.Now())
+			mu.Lock()
+			if len(busy) > 0 {
+				endpoints := make([]string, 0, len(busy))
+				for endpoint := range busy {
+					endpoints = append(endpoints, endpoint)
+				}
+				query = query.Where("url NOT IN ?", endpoints)
+			}
+			mu.Unlock()
+			var due []WebhookDelivery
+			query.Order("next_attempt_at").Limit(100).Find(&due)
+
+			var endpoints []string
+			batches := map[string][]WebhookDelivery{}
+			for _, delivery := range due {
+				if _, ok := batches[delivery.URL]; !ok {
+					endpoints = append(endpoints, delivery.URL)
+				}
+				batches[delivery.URL] = append(batches[delivery.URL], delivery)
+			}
+			for _, endpoint := range endpoints {
+				mu.Lock()
+				busy[endpoint] = true
+				mu.Unlock()
+				workers <- struct{}{}
+				go func(endpoint string, batch []WebhookDelivery) {
+					defer func() {
+						mu.Lock()
+						delete(busy, endpoint)
+						mu.Unlock()
+						<-workers
+					}()
+					for i := range batch {
+						deliverWebhook(client, &batch[i], maxAttempts)
+					}
+				}(endpoint, batches[endpoint])
+			}
+			time.Sleep(webhookPollInterval)
+		}
+	}()
+}
+
+// WebhookRequest is the body of POST /webhooks
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// Handler function creating a webhook subscription
+func createWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithFields(c, FieldErrors{"body": fmt.Sprintf("invalid JSON: %v", err)})
+		return
+	}
+	errs := FieldErrors{}
+	if err := checkPublicURL(req.URL); err != nil {
+		errs["url"] = err.Error()
+	}
+	if len(req.Events) == 0 {
+		errs["events"] = fmt.Sprintf("at least one event is required, one of %s or *", strings.Join(webhookEventTypes, ", "))
+	}
+	for _, event := range req.Events {
+		if event != "*" && !contains(webhookEventTypes, event) {
+			errs["events"] = fmt.Sprintf("unknown event %q, use one of %s or *", event, strings.Join(webhookEventTypes, ", "))
+		}
+	}
+	if len(errs) > 0 {
+		abortWithFields(c, errs)
+		return
+	}
+	// the secret is only shown once, at creation
+	if req.Secret == "" {
+		req.Secret = generateRandomKey()
+	}
+	subscription := WebhookSubscription{
+		URL:        req.URL,
+		EventTypes: strings.Join(req.Events, ","),
+		Secret:     req.Secret,
+		Active:     true,
+	}
+	if err := _botdb.Create(&subscription).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	response := subscription.response()
+	response.Secret = subscription.Secret
+	c.JSON(http.StatusCreated, response)
+}
+
+// Handler function listing the webhook subscriptions
+func listWebhooks(c *gin.Context) {
+	var subscriptions []WebhookSubscription
+	if err := _botdb.Order("id").Find(&subscriptions).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	list := make([]WebhookResponse, len(subscriptions))
+	for i := range subscriptions {
+		list[i] = subscriptions[i].response()
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// Handler function deleting a webhook subscription, its pending deliveries are dropped
+func deleteWebhook(c *gin.Context) {
+	result := _botdb.Delete(&WebhookSubscription{}, "id = ?", c.Param("id"))
+	if result.Error != nil || result.RowsAffected == 0 {
+		abortWithError(c, http.StatusNotFound, CodeNotFound, "Webhook not found")
+		return
+	}
+	_botdb.Where("subscription_id = ? AND status = ?", c.Param("id"), DeliveryPending).Delete(&WebhookDelivery{})
+	c.Status(http.StatusNoContent)
+}
+
+// GetWebhookPanel lists the subscriptions and the dead-letter deliveries in the admin panel
+func GetWebhookPanel(ctx *context.Context) (types.Panel, error) {
+	var subscriptions []WebhookSubscription
+	if err := _botdb.Order("id").Find(&subscriptions).Error; err != nil {
+		return types.Panel{}, err
+	}
+	var dead []WebhookDelivery
+	if err := _botdb.Where("status = ?", DeliveryDead).Order("id desc").Limit(100).Find(&dead).Error; err != nil {
+		return types.Panel{}, err
+	}
+	var content strings.Builder
+	content.WriteString("<h4>Subscriptions</h4><table class=\"table table-bordered\"><tr><th>ID</th><th>URL</th><th>Events</th><th>Active</th></tr>")
+	for _, subscription := range subscriptions {
+		content.WriteString(fmt.Sprintf("<tr><td>%d</td><td>%s</td><td>%s</td><td>%v</td></tr>",
+			subscription.ID, template.HTMLEscapeString(subscription.URL), template.HTMLEscapeString(subscription.EventTypes), subscription.Active))
+	}
+	content.WriteString("</table><h4>Dead letters</h4><table class=\"table table-bordered\"><tr><th>ID</th><th>URL</th><th>Event</th><th>Attempts</th><th>Last error</th><th>Created</th><th></th></tr>")
+	csrf := csrfField(_adminTokens.AddToken())
+	for _, delivery := range dead {
+		content.WriteString(fmt.Sprintf("<tr><td>%d</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td><form method=\"post\" action=\"/admin/webhooks/retry\">%s<input type=\"hidden\" name=\"id\" value=\"%d\"><button type=\"submit\" class=\"btn btn-xs btn-default\">Retry</button></form></td></tr>",
+			delivery.ID, template.HTMLEscapeString(delivery.URL), delivery.Event, delivery.Attempts,
+			template.HTMLEscapeString(delivery.LastError), delivery.CreatedAt.Format(time.RFC3339), csrf, delivery.ID))
+	}
+	content.WriteString("</table>")
+	return types.Panel{
+		Content:     template.HTML(content.String()),
+		Title:       "Webhooks",
+		Description: "Subscriptions and dead letters",
+	}, nil
+}
+
+// retryDeadLetter queues a dead delivery again with a fresh set of attempts
+func retryDeadLetter(ctx *context.Context) {
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err == nil && checkCSRF(ctx) == nil {
+		_botdb.Model(&WebhookDelivery{}).Where("id = ? AND status = ?", id, DeliveryDead).
+			Updates(map[string]interface{}{"status": DeliveryPending, "attempts": 0, "next_attempt_at": time.Now()})
+	}
+	ctx.Write(http.StatusFound, map[string]string{"Location": "/admin/info/webhooks"}, "")
+}